@@ -0,0 +1,117 @@
+package gluahttp
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// DefaultBatchConcurrency is the number of requests of a batch sent at the same time
+// when the script doesn't set concurrency
+const DefaultBatchConcurrency = 10
+
+// batchResult is what the goroutine sending a request of the batch produced,
+// it's converted to lua once every request is done
+type batchResult struct {
+	resp     *http.Response
+	attempts int
+	err      error
+}
+
+// doBatch sends requests like { {method = "GET", url = "", opts = {}}, ... } in
+// goroutines and returns the responses and the errors indexed like the requests
+func (self *httpModule) doBatch(L *lua.LState, sess *session, requests *lua.LTable, options *lua.LTable) (*lua.LTable, *lua.LTable, error) {
+	concurrency := DefaultBatchConcurrency
+	if options != nil {
+		if reqConcurrency, ok := options.RawGetString("concurrency").(lua.LNumber); ok {
+			concurrency = int(reqConcurrency)
+		}
+	}
+	if concurrency <= 0 {
+		return nil, nil, fmt.Errorf("invalid concurrency %d", concurrency)
+	}
+
+	n := requests.Len()
+	prepared := make([]*preparedRequest, n)
+	results := make([]batchResult, n)
+
+	// Options are lua values, the requests are built on the calling state
+	for i := 0; i < n; i++ {
+		entry, ok := requests.RawGetInt(i + 1).(*lua.LTable)
+		if !ok {
+			results[i].err = newRequestError(KindInvalidOptions, "", errors.New("request must be a table"))
+			continue
+		}
+
+		urlStr, ok := entry.RawGetString("url").(lua.LString)
+		if !ok {
+			results[i].err = newRequestError(KindInvalidOptions, "", errors.New("request url expected"))
+			continue
+		}
+
+		method := "GET"
+		if reqMethod, ok := entry.RawGetString("method").(lua.LString); ok {
+			method = strings.ToUpper(reqMethod.String())
+		}
+
+		reqOptions, _ := entry.RawGetString("opts").(*lua.LTable)
+		p, err := self.prepareRequest(L, sess, method, urlStr.String(), reqOptions)
+		if err == nil {
+			if err = p.ro.checkAsync(); err != nil {
+				p.ro.CloseFiles()
+				p, err = nil, newRequestError(KindInvalidOptions, urlStr.String(), err)
+			}
+		}
+		prepared[i], results[i].err = p, err
+	}
+
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, concurrency)
+	for i, p := range prepared {
+		if p == nil {
+			continue
+		}
+
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, p *preparedRequest) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+
+			resp, attempts, err := p.send()
+			if err == nil && !p.ro.Stream {
+				bufferBody(resp, p.ro.MaxBodySize)
+			}
+			results[i] = batchResult{resp: resp, attempts: attempts, err: err}
+		}(i, p)
+	}
+	wg.Wait()
+
+	responses := L.CreateTable(n, 0)
+	errs := L.NewTable()
+	for i, result := range results {
+		if prepared[i] != nil {
+			prepared[i].ro.CloseFiles()
+		}
+
+		if result.err != nil {
+			errs.RawSetInt(i+1, errorValue(L, result.err))
+			continue
+		}
+
+		luaResp, err := prepared[i].response(L, result.resp, result.attempts)
+		if err != nil {
+			errs.RawSetInt(i+1, errorValue(L, err))
+			continue
+		}
+		responses.RawSetInt(i+1, luaResp)
+	}
+
+	return responses, errs, nil
+}
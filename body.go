@@ -0,0 +1,177 @@
+package gluahttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const bodyTypeName = "http.body"
+
+// bodyReader is the body of a streamed response, the connection is held until
+// the body is read to the end or closed
+type bodyReader struct {
+	mu     sync.Mutex
+	body   io.ReadCloser
+	reader *bufio.Reader
+	closed bool
+}
+
+func newBodyReader(body io.ReadCloser) *bodyReader {
+	return &bodyReader{
+		body:   body,
+		reader: bufio.NewReader(body),
+	}
+}
+
+func registerBodyType(L *lua.LState) {
+	mt := L.NewTypeMetatable(bodyTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"read":  bodyRead,
+		"lines": bodyLines,
+		"close": bodyClose,
+	}))
+}
+
+func (self *bodyReader) userData(L *lua.LState) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = self
+	L.SetMetatable(ud, L.GetTypeMetatable(bodyTypeName))
+	return ud
+}
+
+func checkBody(L *lua.LState) *bodyReader {
+	ud := L.CheckUserData(1)
+	if body, ok := ud.Value.(*bodyReader); ok {
+		return body
+	}
+	L.ArgError(1, "body expected")
+	return nil
+}
+
+// read returns up to n bytes, or everything left when n is omitted,
+// nil means the body was read to the end
+func (self *bodyReader) read(n int) ([]byte, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.closed {
+		return nil, io.EOF
+	}
+
+	var buf []byte
+	var err error
+	if n < 0 {
+		buf, err = ioutil.ReadAll(self.reader)
+		if err == nil && len(buf) == 0 {
+			err = io.EOF
+		}
+	} else {
+		buf = make([]byte, n)
+		n, err = io.ReadFull(self.reader, buf)
+		buf = buf[:n]
+		if err == io.ErrUnexpectedEOF || (err == io.EOF && n > 0) {
+			err = nil
+		}
+	}
+
+	if err == io.EOF {
+		self.close()
+	}
+	return buf, err
+}
+
+// readLine returns the next line without the line break
+func (self *bodyReader) readLine() (string, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.closed {
+		return "", io.EOF
+	}
+
+	line, err := self.reader.ReadString('\n')
+	if err == io.EOF {
+		self.close()
+		if line != "" {
+			err = nil
+		}
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), err
+}
+
+func (self *bodyReader) close() error {
+	if self.closed {
+		return nil
+	}
+	self.closed = true
+	return self.body.Close()
+}
+
+// bodyRead implements body:read(n)
+func bodyRead(L *lua.LState) int {
+	body := checkBody(L)
+	n := L.OptInt(2, -1)
+
+	buf, err := body.read(n)
+	if err == io.EOF {
+		L.Push(lua.LNil)
+		return 1
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(errorValue(L, err))
+		return 2
+	}
+
+	L.Push(lua.LString(buf))
+	return 1
+}
+
+// bodyLines implements for line in body:lines() do ... end
+func bodyLines(L *lua.LState) int {
+	body := checkBody(L)
+	L.Push(L.NewFunction(func(L *lua.LState) int {
+		line, err := body.readLine()
+		if err == io.EOF {
+			L.Push(lua.LNil)
+			return 1
+		}
+		if err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+
+		L.Push(lua.LString(line))
+		return 1
+	}))
+	return 1
+}
+
+func bodyClose(L *lua.LState) int {
+	body := checkBody(L)
+	body.mu.Lock()
+	defer body.mu.Unlock()
+
+	body.close()
+	return 0
+}
+
+// bufferBody reads the body ahead so that the response can later be converted
+// to lua without touching the network, one byte over limit is kept so that
+// getRespBody still reports the truncation
+func bufferBody(resp *http.Response, limit int64) {
+	var reader io.Reader = resp.Body
+	if limit > 0 {
+		reader = io.LimitReader(resp.Body, limit+1)
+	}
+
+	buf, _ := ioutil.ReadAll(reader)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(buf))
+}
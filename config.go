@@ -0,0 +1,83 @@
+package gluahttp
+
+import (
+	"time"
+)
+
+// DefaultTimeout is used when neither the module config nor the script sets a timeout
+const DefaultTimeout = 30 * time.Second
+
+// DefaultMaxRawSize is used when neither the module config nor the script sets max_raw_size
+const DefaultMaxRawSize = 1 << 20
+
+// Config holds the defaults applied to every request made by the module,
+// the options passed by the lua script take precedence over them
+type Config struct {
+	// Headers are added to every request, headers set by the script with the same
+	// name replace them
+	Headers map[string]string
+
+	// UserAgent is sent when the script doesn't set a User-Agent header,
+	// when empty the Go default is used
+	UserAgent string
+
+	// Timeout of a whole request, zero means DefaultTimeout and a negative
+	// value disables the timeout
+	Timeout time.Duration
+
+	// InsecureSkipVerify disables the server certificate verification by default
+	InsecureSkipVerify bool
+
+	// DisableRedirect stops following redirects by default
+	DisableRedirect bool
+
+	// DisableCompression disables gzip compression by default
+	DisableCompression bool
+
+	// MaxBodySize is the default maximum number of bytes read from a response
+	// body, zero means no limit
+	MaxBodySize int64
+
+	// MaxRawSize is the default maximum number of bytes of a request kept in
+	// request.raw, zero means DefaultMaxRawSize and a negative value disables the limit
+	MaxRawSize int64
+
+	// Interceptors wrap every request sent by the sync and async modules, each
+	// attempt of a retried request goes through them
+	Interceptors []Interceptor
+
+	// DialPolicy restricts the addresses the scripts can connect to, nil allows
+	// every address
+	DialPolicy *DialPolicy
+
+	// Quota is applied to every lua state using the module, SetQuota overrides it
+	// for a state. nil doesn't track the usage
+	Quota *Quota
+}
+
+// defaultConfig keeps the behaviour of the module before it was configurable
+func defaultConfig() Config {
+	return Config{
+		Headers: map[string]string{"X-SCANNER": "ZERO"},
+	}
+}
+
+func (c Config) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultTimeout
+	}
+	if c.Timeout < 0 {
+		return 0
+	}
+	return c.Timeout
+}
+
+func (c Config) maxRawSize() int64 {
+	if c.MaxRawSize == 0 {
+		return DefaultMaxRawSize
+	}
+	if c.MaxRawSize < 0 {
+		return 0
+	}
+	return c.MaxRawSize
+}
@@ -0,0 +1,277 @@
+package gluahttp
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// download holds the options of a download besides the request ones
+type download struct {
+	path     string
+	resume   bool
+	ifRange  string
+	hashName string
+	expected string
+}
+
+// parseDownload reads resume, if_range and checksum = "sha256:<hex>" from the options
+func parseDownload(path string, options *lua.LTable) (*download, error) {
+	d := &download{path: path}
+	if options == nil {
+		return d, nil
+	}
+
+	if resume, ok := options.RawGetString("resume").(lua.LBool); ok {
+		d.resume = bool(resume)
+	}
+
+	if ifRange, ok := options.RawGetString("if_range").(lua.LString); ok {
+		d.ifRange = ifRange.String()
+	}
+
+	if checksum, ok := options.RawGetString("checksum").(lua.LString); ok {
+		parts := strings.SplitN(checksum.String(), ":", 2)
+		if len(parts) != 2 || checksumAlgorithms[strings.ToLower(parts[0])] == nil {
+			return nil, fmt.Errorf("invalid checksum %s, expected md5:<hex>, sha1:<hex> or sha256:<hex>", checksum)
+		}
+		d.hashName = strings.ToLower(parts[0])
+		d.expected = strings.ToLower(parts[1])
+	}
+
+	return d, nil
+}
+
+// offset returns the size of the partial file to resume from, 0 when the
+// download starts from scratch
+func (d *download) offset() int64 {
+	if !d.resume {
+		return 0
+	}
+	info, err := os.Stat(d.path)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
+
+// validatorPath is where write saves the validator of the response the file
+// comes from, it's kept next to the file so that an interrupted download has it
+func (d *download) validatorPath() string {
+	return d.path + ".validator"
+}
+
+// responseValidator returns the strong ETag of the response, or its Last-Modified,
+// which can be sent back as If-Range
+func responseValidator(resp *http.Response) string {
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	return validator
+}
+
+// saveValidator keeps the validator of the response as the If-Range of the next
+// resume, only when resume is set. A whole file without any removes the old one,
+// a resumed part without any keeps it
+func (d *download) saveValidator(resp *http.Response) {
+	if !d.resume {
+		return
+	}
+	validator := responseValidator(resp)
+	if validator == "" {
+		if resp.StatusCode != http.StatusPartialContent {
+			os.Remove(d.validatorPath())
+		}
+		return
+	}
+	ioutil.WriteFile(d.validatorPath(), []byte(validator), 0644)
+}
+
+// setRange asks for the rest of the partial file, If-Range makes the server send
+// the whole file again when it changed since the partial file was written. No
+// If-Range is sent when neither the script nor a previous download gave one
+func (d *download) setRange(req *http.Request, offset int64) {
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	ifRange := d.ifRange
+	if ifRange == "" {
+		if validator, err := ioutil.ReadFile(d.validatorPath()); err == nil {
+			ifRange = strings.TrimSpace(string(validator))
+		}
+	}
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+}
+
+// contentRangeStart returns the first byte of a "bytes start-end/size" Content-Range
+func contentRangeStart(value string) (int64, error) {
+	value = strings.TrimPrefix(value, "bytes ")
+	i := strings.Index(value, "-")
+	if i < 0 {
+		return 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	return strconv.ParseInt(value[:i], 10, 64)
+}
+
+// contentRangeSize returns the size of a "bytes */size" Content-Range
+func contentRangeSize(value string) (int64, bool) {
+	i := strings.LastIndex(value, "/")
+	if i < 0 {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(value[i+1:], 10, 64)
+	return size, err == nil
+}
+
+// write saves the body of the response to the file and returns the number of bytes
+// written and whether the partial file was resumed. Error responses are not written
+func (d *download) write(resp *http.Response, offset int64) (int64, bool, error) {
+	defer resp.Body.Close()
+
+	var flag int
+	resumed := false
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return 0, false, err
+		}
+		if start != offset {
+			return 0, false, fmt.Errorf("server resumed the download at %d instead of %d", start, offset)
+		}
+		flag = os.O_WRONLY | os.O_APPEND
+		resumed = true
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file is already complete
+		if size, ok := contentRangeSize(resp.Header.Get("Content-Range")); ok && size == offset {
+			return 0, true, nil
+		}
+		return 0, false, nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	default:
+		return 0, false, nil
+	}
+
+	file, err := os.OpenFile(d.path, flag, 0644)
+	if err != nil {
+		return 0, false, err
+	}
+	d.saveValidator(resp)
+
+	written, err := io.Copy(file, resp.Body)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return written, resumed, err
+	}
+
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(d.path, lastModified, lastModified)
+	}
+	return written, resumed, nil
+}
+
+// verify hashes the whole file, including the part written by a previous download
+func (d *download) verify(urlStr string) (string, error) {
+	if d.hashName == "" {
+		return "", nil
+	}
+
+	file, err := os.Open(d.path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := checksumAlgorithms[d.hashName]()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != d.expected {
+		// Don't let a later resume append to a corrupted file
+		os.Remove(d.path)
+		os.Remove(d.validatorPath())
+		return sum, newRequestError(KindChecksum, urlStr, fmt.Errorf("%s checksum mismatch: expected %s, got %s", d.hashName, d.expected, sum))
+	}
+	return sum, nil
+}
+
+// doDownload streams the response to path, the timeout of the request bounds the
+// whole transfer like for the other requests. It returns
+// { status_code = 200, bytes_written = 0, size = 0, resumed = false, checksum = "", validator = "", headers = {}, url = "", attempts = 1 }
+func (self *httpModule) doDownload(L *lua.LState, sess *session, urlStr, path string, options *lua.LTable) (lua.LValue, error) {
+	d, err := parseDownload(path, options)
+	if err != nil {
+		return lua.LNil, newRequestError(KindInvalidOptions, urlStr, err)
+	}
+
+	prepared, err := self.prepareRequest(L, sess, "GET", urlStr, options)
+	if err != nil {
+		return lua.LNil, err
+	}
+	defer prepared.ro.CloseFiles()
+
+	offset := d.offset()
+	if offset > 0 {
+		d.setRange(prepared.req, offset)
+	}
+
+	resp, attempts, err := prepared.send()
+	if err != nil {
+		return lua.LNil, err
+	}
+
+	written, resumed, err := d.write(resp, offset)
+	if err != nil {
+		return lua.LNil, err
+	}
+
+	result := L.NewTable()
+	result.RawSetString("status_code", lua.LNumber(resp.StatusCode))
+	result.RawSetString("bytes_written", lua.LNumber(written))
+	result.RawSetString("resumed", lua.LBool(resumed))
+	result.RawSetString("headers", getHeaders(L, resp.Header))
+	result.RawSetString("url", lua.LString(resp.Request.URL.String()))
+	result.RawSetString("attempts", lua.LNumber(attempts))
+	if validator := responseValidator(resp); validator != "" {
+		result.RawSetString("validator", lua.LString(validator))
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		result.RawSetString("size", lua.LNumber(info.Size()))
+	}
+
+	// Only a file which was completely downloaded can be verified
+	if (resp.StatusCode >= 200 && resp.StatusCode < 300) || resumed {
+		sum, err := d.verify(resp.Request.URL.String())
+		if err != nil {
+			return lua.LNil, err
+		}
+		result.RawSetString("checksum", lua.LString(sum))
+	}
+
+	return result, nil
+}
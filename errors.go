@@ -0,0 +1,188 @@
+package gluahttp
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const errorTypeName = "http.error"
+
+// Kinds of request errors returned to lua in the kind field
+const (
+	KindDNS               = "dns"
+	KindConnectionRefused = "connection_refused"
+	KindConnectionReset   = "connection_reset"
+	KindConnectionClosed  = "connection_closed"
+	KindTimeout           = "timeout"
+	KindCanceled          = "canceled"
+	KindTLS               = "tls"
+	KindCertificate       = "certificate"
+	KindRedirect          = "redirect"
+	KindProxy             = "proxy"
+	KindBlocked           = "blocked"
+	KindInvalidURL        = "invalid_url"
+	KindInvalidOptions    = "invalid_options"
+	KindInvalidRequest    = "invalid_request"
+	KindChecksum          = "checksum"
+	KindHook              = "hook"
+	KindQuotaExceeded     = "quota_exceeded"
+	KindUnknown           = "unknown"
+)
+
+// requestError is the structured form of the errors returned to lua
+type requestError struct {
+	Kind      string
+	Message   string
+	URL       string
+	Op        string
+	Temporary bool
+	Timeout   bool
+	Err       error
+}
+
+func (e *requestError) Error() string {
+	return e.Message
+}
+
+func (e *requestError) Unwrap() error {
+	return e.Err
+}
+
+// newRequestError tags an error found before the request was sent
+func newRequestError(kind string, urlStr string, err error) *requestError {
+	return &requestError{
+		Kind:    kind,
+		Message: err.Error(),
+		URL:     urlStr,
+		Err:     err,
+	}
+}
+
+// classifyError walks the error chain returned by the client to find out what failed
+func classifyError(err error) *requestError {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return reqErr
+	}
+
+	e := &requestError{
+		Kind:    KindUnknown,
+		Message: err.Error(),
+		Err:     err,
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		e.URL = urlErr.URL
+		e.Op = strings.ToLower(urlErr.Op)
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		e.Op = opErr.Op
+	}
+
+	if t, ok := err.(interface{ Temporary() bool }); ok {
+		e.Temporary = t.Temporary()
+	}
+	if t, ok := err.(interface{ Timeout() bool }); ok {
+		e.Timeout = t.Timeout()
+	}
+
+	var dnsErr *net.DNSError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+
+	switch {
+	case errors.Is(err, errTooManyRedirects):
+		e.Kind = KindRedirect
+		e.Op = "redirect"
+	case errors.As(err, &dnsErr):
+		e.Kind = KindDNS
+		e.Op = "lookup"
+		e.Temporary = dnsErr.IsTemporary || dnsErr.IsTimeout
+	case e.Timeout || errors.Is(err, context.DeadlineExceeded):
+		e.Kind = KindTimeout
+		e.Timeout = true
+	case errors.Is(err, context.Canceled):
+		e.Kind = KindCanceled
+	case errors.As(err, &unknownAuthorityErr), errors.As(err, &hostnameErr), errors.As(err, &certificateInvalidErr):
+		e.Kind = KindCertificate
+		e.Op = "tls"
+	case e.Op == "proxyconnect" || e.Op == "socks connect":
+		e.Kind = KindProxy
+	case errors.Is(err, syscall.ECONNREFUSED):
+		e.Kind = KindConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		e.Kind = KindConnectionReset
+		e.Temporary = true
+	case isTLSError(err):
+		e.Kind = KindTLS
+		e.Op = "tls"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		e.Kind = KindConnectionClosed
+		e.Temporary = true
+	}
+
+	return e
+}
+
+// isTLSError detects handshake failures, crypto/tls reports most of them as
+// plain errors prefixed with "tls: "
+func isTLSError(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if strings.HasPrefix(err.Error(), "tls: ") {
+			return true
+		}
+	}
+	return false
+}
+
+func registerErrorType(L *lua.LState) {
+	mt := L.NewTypeMetatable(errorTypeName)
+	L.SetField(mt, "__tostring", L.NewFunction(errorToString))
+	L.SetField(mt, "__concat", L.NewFunction(errorConcat))
+}
+
+// errorToString keeps tostring(err) returning the message scripts used to get
+func errorToString(L *lua.LState) int {
+	L.Push(L.CheckTable(1).RawGetString("message"))
+	return 1
+}
+
+func errorConcat(L *lua.LState) int {
+	L.Push(lua.LString(errorString(L.Get(1)) + errorString(L.Get(2))))
+	return 1
+}
+
+func errorString(value lua.LValue) string {
+	if table, ok := value.(*lua.LTable); ok {
+		return lua.LVAsString(table.RawGetString("message"))
+	}
+	return lua.LVAsString(value)
+}
+
+// errorValue converts an error into the table returned to lua:
+// { kind = "", message = "", url = "", op = "", temporary = false, timeout = false }
+func errorValue(L *lua.LState, err error) *lua.LTable {
+	e := classifyError(err)
+
+	table := L.NewTable()
+	table.RawSetString("kind", lua.LString(e.Kind))
+	table.RawSetString("message", lua.LString(e.Message))
+	table.RawSetString("url", lua.LString(e.URL))
+	table.RawSetString("op", lua.LString(e.Op))
+	table.RawSetString("temporary", lua.LBool(e.Temporary))
+	table.RawSetString("timeout", lua.LBool(e.Timeout))
+	L.SetMetatable(table, L.GetTypeMetatable(errorTypeName))
+	return table
+}
@@ -0,0 +1,302 @@
+package gluahttp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const futureTypeName = "http.future"
+
+var errWaitTimeout = errors.New("timed out waiting for the response")
+
+// future is a request sent in a goroutine. The goroutine only produces Go values,
+// they are converted to lua by wait on the state which owns the future
+type future struct {
+	prepared *preparedRequest
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	resp     *http.Response
+	attempts int
+	err      error
+
+	// The converted response is kept so that wait can be called several times
+	once     sync.Once
+	luaResp  lua.LValue
+	luaError lua.LValue
+}
+
+// newFuture starts sending the prepared request, prepared is nil when building
+// the request failed with err
+func newFuture(prepared *preparedRequest, err error) *future {
+	f := &future{
+		prepared: prepared,
+		cancel:   func() {},
+		done:     make(chan struct{}),
+		err:      err,
+	}
+
+	if prepared == nil {
+		close(f.done)
+		return f
+	}
+
+	var ctx context.Context
+	ctx, f.cancel = context.WithCancel(prepared.req.Context())
+	prepared.req = prepared.req.WithContext(ctx)
+
+	go func() {
+		defer close(f.done)
+		defer prepared.ro.CloseFiles()
+
+		// The context is released once the response is in memory, a streamed
+		// body keeps it until the body is closed
+		f.resp, f.attempts, f.err = prepared.send()
+		if f.err == nil && prepared.ro.Stream {
+			f.resp.Body = &cancelBody{ReadCloser: f.resp.Body, cancel: f.cancel}
+			return
+		}
+		if f.err == nil {
+			bufferBody(f.resp, prepared.ro.MaxBodySize)
+		}
+		f.cancel()
+	}()
+	return f
+}
+
+// cancelBody releases the context of a future when its streamed body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func registerFutureType(L *lua.LState) {
+	mt := L.NewTypeMetatable(futureTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"wait":   futureWait,
+		"done":   futureDone,
+		"cancel": futureCancel,
+	}))
+}
+
+func (self *future) userData(L *lua.LState) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = self
+	L.SetMetatable(ud, L.GetTypeMetatable(futureTypeName))
+	return ud
+}
+
+func checkFuture(L *lua.LState, n int) *future {
+	ud := L.CheckUserData(n)
+	if f, ok := ud.Value.(*future); ok {
+		return f
+	}
+	L.ArgError(n, "future expected")
+	return nil
+}
+
+func (self *future) isDone() bool {
+	select {
+	case <-self.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// result converts the outcome of the request, it must only be called once done is closed
+func (self *future) result(L *lua.LState) (lua.LValue, lua.LValue) {
+	self.once.Do(func() {
+		if self.err != nil {
+			self.luaResp, self.luaError = lua.LNil, errorValue(L, self.err)
+			return
+		}
+		luaResp, err := self.prepared.response(L, self.resp, self.attempts)
+		if err != nil {
+			self.luaResp, self.luaError = lua.LNil, errorValue(L, err)
+			return
+		}
+		self.luaResp, self.luaError = luaResp, lua.LNil
+	})
+	return self.luaResp, self.luaError
+}
+
+// waitTimeoutError is returned when a wait gives up before the response arrived
+func (self *future) waitTimeoutError(L *lua.LState) *lua.LTable {
+	urlStr := ""
+	if self.prepared != nil {
+		urlStr = self.prepared.req.URL.String()
+	}
+
+	return errorValue(L, &requestError{
+		Kind:    KindTimeout,
+		Message: errWaitTimeout.Error(),
+		URL:     urlStr,
+		Op:      "wait",
+		Timeout: true,
+		Err:     errWaitTimeout,
+	})
+}
+
+// timeoutChan returns a channel firing after the timeout in seconds,
+// nil waits forever
+func timeoutChan(L *lua.LState, n int) <-chan time.Time {
+	timeout := L.OptNumber(n, -1)
+	if timeout < 0 {
+		return nil
+	}
+	return time.After(time.Duration(float64(timeout) * float64(time.Second)))
+}
+
+// futureWait implements future:wait(timeout), it returns the response or nil and
+// the error like the sync functions
+func futureWait(L *lua.LState) int {
+	f := checkFuture(L, 1)
+
+	// A done future wins over a timeout which already expired
+	if !f.isDone() {
+		select {
+		case <-f.done:
+		case <-timeoutChan(L, 2):
+			L.Push(lua.LNil)
+			L.Push(f.waitTimeoutError(L))
+			return 2
+		}
+	}
+
+	resp, err := f.result(L)
+	L.Push(resp)
+	if err != lua.LNil {
+		L.Push(err)
+		return 2
+	}
+	return 1
+}
+
+func futureDone(L *lua.LState) int {
+	L.Push(lua.LBool(checkFuture(L, 1).isDone()))
+	return 1
+}
+
+// futureCancel aborts the request, wait then returns a canceled error.
+// It returns false when the request was already done
+func futureCancel(L *lua.LState) int {
+	f := checkFuture(L, 1)
+	if f.isDone() {
+		L.Push(lua.LFalse)
+		return 1
+	}
+
+	f.cancel()
+	L.Push(lua.LTrue)
+	return 1
+}
+
+func checkFutures(L *lua.LState) []*future {
+	table := L.CheckTable(1)
+	futures := make([]*future, table.Len())
+	for i := range futures {
+		ud, ok := table.RawGetInt(i + 1).(*lua.LUserData)
+		if !ok {
+			L.ArgError(1, "futures expected")
+		}
+		f, ok := ud.Value.(*future)
+		if !ok {
+			L.ArgError(1, "futures expected")
+		}
+		futures[i] = f
+	}
+	return futures
+}
+
+// waitAny implements http.wait_any(futures, timeout), it returns the index of the
+// first future done along with its response and error, or nil and a timeout error
+func waitAny(L *lua.LState) int {
+	futures := checkFutures(L)
+	if len(futures) == 0 {
+		L.ArgError(1, "no future to wait for")
+	}
+
+	// The futures already done are taken in order before waiting, select picks
+	// at random among the ready channels, an expired timeout included
+	chosen := -1
+	for i, f := range futures {
+		if f.isDone() {
+			chosen = i
+			break
+		}
+	}
+
+	if chosen < 0 {
+		cases := make([]reflect.SelectCase, 0, len(futures)+1)
+		for _, f := range futures {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(f.done)})
+		}
+		if timeout := timeoutChan(L, 2); timeout != nil {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timeout)})
+		}
+		chosen, _, _ = reflect.Select(cases)
+	}
+	if chosen == len(futures) {
+		L.Push(lua.LNil)
+		L.Push(lua.LNil)
+		L.Push(futures[0].waitTimeoutError(L))
+		return 3
+	}
+
+	resp, err := futures[chosen].result(L)
+	L.Push(lua.LNumber(chosen + 1))
+	L.Push(resp)
+	L.Push(err)
+	return 3
+}
+
+// waitAll implements http.wait_all(futures, timeout), it returns the responses and
+// the errors at the index of their future like http.batch. The futures still running
+// when the timeout expires get a timeout error
+func waitAll(L *lua.LState) int {
+	futures := checkFutures(L)
+	timeout := timeoutChan(L, 2)
+
+	responses := L.CreateTable(len(futures), 0)
+	errs := L.NewTable()
+	timedOut := false
+	for i, f := range futures {
+		if !timedOut {
+			select {
+			case <-f.done:
+			case <-timeout:
+				timedOut = true
+			}
+		}
+
+		if !f.isDone() {
+			errs.RawSetInt(i+1, f.waitTimeoutError(L))
+			continue
+		}
+
+		resp, err := f.result(L)
+		if err != lua.LNil {
+			errs.RawSetInt(i+1, err)
+			continue
+		}
+		responses.RawSetInt(i+1, resp)
+	}
+
+	L.Push(responses)
+	L.Push(errs)
+	return 2
+}
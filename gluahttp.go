@@ -1,44 +1,78 @@
 package gluahttp
 
 import (
+	"sync"
+
 	"github.com/Greyh4t/dnscache"
 	"github.com/yuin/gopher-lua"
 )
 
 type httpModule struct {
 	resolver *dnscache.Resolver
+	config   Config
+	policy   *dialPolicy
+
+	quotaMu sync.Mutex
+	quotas  map[*lua.Global]*stateQuota
 }
 
-func New(resolver *dnscache.Resolver) *httpModule {
-	return &httpModule{
+// New creates the module, the optional config replaces the default one
+// which only adds the X-SCANNER header to every request
+func New(resolver *dnscache.Resolver, config ...Config) *httpModule {
+	module := &httpModule{
 		resolver: resolver,
+		config:   defaultConfig(),
+		quotas:   map[*lua.Global]*stateQuota{},
 	}
+	if len(config) > 0 {
+		module.config = config[0]
+	}
+	module.policy = newDialPolicy(module.config.DialPolicy)
+	return module
 }
 
 func (self *httpModule) Loader(L *lua.LState) int {
 	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
-		"get":     self.get,
-		"delete":  self.delete,
-		"head":    self.head,
-		"patch":   self.patch,
-		"post":    self.post,
-		"put":     self.put,
-		"options": self.options,
+		"get":      self.get,
+		"delete":   self.delete,
+		"head":     self.head,
+		"patch":    self.patch,
+		"post":     self.post,
+		"put":      self.put,
+		"options":  self.options,
+		"download": self.download,
+		"batch":    self.batch,
+		"raw":      self.raw,
+		"session":  self.session,
 	})
+	mod.RawSetString("null", luaNull(L))
+	registerSessionType(L)
+	registerResponseType(L)
+	registerBodyType(L)
+	registerErrorType(L)
 	L.Push(mod)
 	return 1
 }
 
+// AsyncLoader loads a module whose functions send the request in a goroutine and
+// return a future right away, future:wait(timeout) returns what the sync function would
 func (self *httpModule) AsyncLoader(L *lua.LState) int {
 	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
-		"get":     self.asyncGet,
-		"delete":  self.asyncPost,
-		"head":    self.asyncHead,
-		"patch":   self.asyncPatch,
-		"post":    self.asyncPost,
-		"put":     self.asyncPut,
-		"options": self.asyncOptions,
+		"get":      self.asyncGet,
+		"delete":   self.asyncDelete,
+		"head":     self.asyncHead,
+		"patch":    self.asyncPatch,
+		"post":     self.asyncPost,
+		"put":      self.asyncPut,
+		"options":  self.asyncOptions,
+		"wait_any": waitAny,
+		"wait_all": waitAll,
 	})
+	mod.RawSetString("null", luaNull(L))
+	registerResponseType(L)
+	registerBodyType(L)
+	registerErrorType(L)
+	registerFutureType(L)
 	L.Push(mod)
 	return 1
 }
@@ -72,12 +106,58 @@ func (self *httpModule) options(L *lua.LState) int {
 	return self.doRequestAndPush(L, "OPTIONS", L.CheckString(1), L.ToTable(2))
 }
 
+// download streams the response body to a file, http.download(url, path, options)
+func (self *httpModule) download(L *lua.LState) int {
+	result, err := self.doDownload(L, nil, L.CheckString(1), L.CheckString(2), L.ToTable(3))
+	return pushResponse(L, result, err)
+}
+
+// batch sends the requests concurrently, http.batch(requests, {concurrency = 10})
+// returns the responses and the errors at the index of their request
+func (self *httpModule) batch(L *lua.LState) int {
+	return self.doBatchAndPush(L, nil, L.CheckTable(1), L.OptTable(2, nil))
+}
+
+func (self *httpModule) doBatchAndPush(L *lua.LState, sess *session, requests *lua.LTable, options *lua.LTable) int {
+	responses, errs, err := self.doBatch(L, sess, requests, options)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(errorValue(L, newRequestError(KindInvalidOptions, "", err)))
+		return 2
+	}
+
+	L.Push(responses)
+	L.Push(errs)
+	return 2
+}
+
+// raw writes hand-crafted bytes to a server, http.raw(host, port, data, {tls = true})
+func (self *httpModule) raw(L *lua.LState) int {
+	result, err := self.doRaw(L, L.CheckString(1), L.CheckInt(2), L.CheckString(3), L.ToTable(4))
+	return pushResponse(L, result, err)
+}
+
+func (self *httpModule) session(L *lua.LState) int {
+	sess, err := newSession(self, L.OptTable(1, nil))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(errorValue(L, newRequestError(KindInvalidOptions, "", err)))
+		return 2
+	}
+
+	L.Push(sess.userData(L))
+	return 1
+}
+
 func (self *httpModule) doRequestAndPush(L *lua.LState, method string, url string, options *lua.LTable) int {
-	response, err := self.doRequest(L, method, url, options)
+	response, err := self.doRequest(L, nil, method, url, options)
+	return pushResponse(L, response, err)
+}
 
+func pushResponse(L *lua.LState, response lua.LValue, err error) int {
 	if err != nil {
 		L.Push(lua.LNil)
-		L.Push(lua.LString(err.Error()))
+		L.Push(errorValue(L, err))
 		return 2
 	}
 
@@ -114,19 +194,16 @@ func (self *httpModule) asyncOptions(L *lua.LState) int {
 	return self.asyncDoRequestAndPush(L, "OPTIONS", L.CheckString(1), L.ToTable(2))
 }
 
+// asyncDoRequestAndPush builds the request on the calling state, only sending it
+// and reading the body happen in the goroutine of the future
 func (self *httpModule) asyncDoRequestAndPush(L *lua.LState, method string, url string, options *lua.LTable) int {
-	resultChan := make(chan lua.LValue, 2)
-
-	go func(L *lua.LState, method string, url string, options *lua.LTable, resultChan chan lua.LValue) {
-		response, err := self.doRequest(L, method, url, options)
-		if err != nil {
-			resultChan <- lua.LNil
-			resultChan <- lua.LString(err.Error())
-		} else {
-			resultChan <- response
+	prepared, err := self.prepareRequest(L, nil, method, url, options)
+	if err == nil {
+		if err = prepared.ro.checkAsync(); err != nil {
+			prepared.ro.CloseFiles()
+			prepared, err = nil, newRequestError(KindInvalidOptions, url, err)
 		}
-		close(resultChan)
-	}(L, method, url, options, resultChan)
-
-	return L.Yield(lua.LChannel(resultChan))
+	}
+	L.Push(newFuture(prepared, err).userData(L))
+	return 1
 }
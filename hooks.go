@@ -0,0 +1,188 @@
+package gluahttp
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// errAsyncRedirectHook is returned when a request sent in a goroutine sets on_redirect
+// or a redirect callback, redirects are followed in the goroutine where lua can't be called
+var errAsyncRedirectHook = errors.New("on_redirect hook and redirect callback are only supported by sync requests")
+
+// requestHooks are the lua callbacks of the hooks option, they are called on the
+// state which made the request
+type requestHooks struct {
+	// BeforeRequest is called with the request table once the request is built,
+	// changes to its method, url, host and headers are applied to the request
+	BeforeRequest *lua.LFunction
+
+	// AfterResponse is called with the response table before it's returned
+	AfterResponse *lua.LFunction
+
+	// OnRedirect is called with the next request and the redirect response before
+	// following a redirect, returning false stops at the redirect response
+	OnRedirect *lua.LFunction
+}
+
+func parseHooks(table *lua.LTable) (*requestHooks, error) {
+	hooks := &requestHooks{}
+	var err error
+	table.ForEach(func(key, value lua.LValue) {
+		fn, ok := value.(*lua.LFunction)
+		if !ok {
+			err = fmt.Errorf("hook %s must be a function", key)
+			return
+		}
+
+		switch key.String() {
+		case "before_request":
+			hooks.BeforeRequest = fn
+		case "after_response":
+			hooks.AfterResponse = fn
+		case "on_redirect":
+			hooks.OnRedirect = fn
+		default:
+			err = fmt.Errorf("unknown hook %s", key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// checkAsync reports the callbacks which can't be used by requests sent in goroutines
+func (ro *requestOptions) checkAsync() error {
+	if ro.RedirectCallback != nil || (ro.Hooks != nil && ro.Hooks.OnRedirect != nil) {
+		return errAsyncRedirectHook
+	}
+	return nil
+}
+
+// callHook calls fn on the state, a lua error or false returned by the hook abort
+// the request. It returns whether the hook returned false
+func callHook(L *lua.LState, name string, fn *lua.LFunction, urlStr string, args ...lua.LValue) (bool, error) {
+	top := L.GetTop()
+	defer L.SetTop(top)
+
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	if err := L.PCall(len(args), 2, nil); err != nil {
+		return false, &requestError{Kind: KindHook, Message: err.Error(), URL: urlStr, Op: name, Err: err}
+	}
+
+	if L.Get(top+1) == lua.LFalse {
+		message := name + " hook returned false"
+		if reason, ok := L.Get(top + 2).(lua.LString); ok {
+			message = reason.String()
+		}
+		return true, &requestError{Kind: KindHook, Message: message, URL: urlStr, Op: name, Err: errors.New(message)}
+	}
+	return false, nil
+}
+
+// hookRequest describes the request to the hooks:
+// { method = "", url = "", host = "", headers = {} }
+func hookRequest(L *lua.LState, req *http.Request) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("method", lua.LString(req.Method))
+	table.RawSetString("url", lua.LString(req.URL.String()))
+	table.RawSetString("host", getHost(req))
+	table.RawSetString("headers", getHeaders(L, req.Header))
+	return table
+}
+
+// redirectResponse describes the redirect response which led to req:
+// { status_code = 302, headers = {}, url = "" }
+func redirectResponse(L *lua.LState, req *http.Request) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("status_code", lua.LNumber(req.Response.StatusCode))
+	table.RawSetString("headers", getHeaders(L, req.Response.Header))
+	table.RawSetString("url", lua.LString(req.Response.Request.URL.String()))
+	return table
+}
+
+// applyHookRequest applies the changes made by a hook to the request table
+func applyHookRequest(table *lua.LTable, req *http.Request) error {
+	if method, ok := table.RawGetString("method").(lua.LString); ok && method != "" {
+		req.Method = method.String()
+	}
+
+	if urlStr, ok := table.RawGetString("url").(lua.LString); ok && urlStr.String() != req.URL.String() {
+		u, err := url.Parse(urlStr.String())
+		if err != nil {
+			return err
+		}
+		req.URL = u
+		req.Host = ""
+	}
+
+	if host, ok := table.RawGetString("host").(lua.LString); ok && string(host) != string(getHost(req)) {
+		req.Host = host.String()
+	}
+
+	if headers, ok := table.RawGetString("headers").(*lua.LTable); ok {
+		req.Header = http.Header{}
+		for key, values := range luaValues(headers) {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+	}
+	return nil
+}
+
+// beforeRequest lets the before_request hook change the built request
+func (h *requestHooks) beforeRequest(L *lua.LState, req *http.Request) error {
+	if h == nil || h.BeforeRequest == nil {
+		return nil
+	}
+
+	table := hookRequest(L, req)
+	if _, err := callHook(L, "before_request", h.BeforeRequest, req.URL.String(), table); err != nil {
+		return err
+	}
+
+	if err := applyHookRequest(table, req); err != nil {
+		return &requestError{Kind: KindHook, Message: err.Error(), URL: req.URL.String(), Op: "before_request", Err: err}
+	}
+	return nil
+}
+
+// afterResponse calls the after_response hook with the converted response
+func (h *requestHooks) afterResponse(L *lua.LState, resp *http.Response, luaResp *lua.LTable) error {
+	if h == nil || h.AfterResponse == nil {
+		return nil
+	}
+
+	_, err := callHook(L, "after_response", h.AfterResponse, resp.Request.URL.String(), luaResp)
+	return err
+}
+
+// redirect calls the on_redirect hook from CheckRedirect, returning false from the
+// hook makes the client return the redirect response
+func (h *requestHooks) redirect(L *lua.LState, req *http.Request) error {
+	if h == nil || h.OnRedirect == nil {
+		return nil
+	}
+
+	table := hookRequest(L, req)
+	stopped, err := callHook(L, "on_redirect", h.OnRedirect, req.URL.String(), table, redirectResponse(L, req))
+	if stopped {
+		return http.ErrUseLastResponse
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := applyHookRequest(table, req); err != nil {
+		return &requestError{Kind: KindHook, Message: err.Error(), URL: req.URL.String(), Op: "on_redirect", Err: err}
+	}
+	return nil
+}
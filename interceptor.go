@@ -0,0 +1,45 @@
+package gluahttp
+
+import (
+	"errors"
+	"net/http"
+)
+
+var errNoResponse = errors.New("interceptor returned neither a response nor an error")
+
+// RoundTripFunc sends a request, it's the next step given to an Interceptor
+type RoundTripFunc func(req *http.Request) (*http.Response, error)
+
+// Interceptor wraps the sending of every request made by the scripts. It can
+// change the request before calling next, inspect the response, or return its
+// own response or error without calling next at all
+type Interceptor func(req *http.Request, next RoundTripFunc) (*http.Response, error)
+
+// chainInterceptors wraps do with the interceptors, the first one is the outermost
+func chainInterceptors(interceptors []Interceptor, do RoundTripFunc) RoundTripFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], do
+		do = func(req *http.Request) (*http.Response, error) {
+			resp, err := interceptor(req, next)
+			if err != nil {
+				return resp, err
+			}
+			if resp == nil {
+				return nil, errNoResponse
+			}
+			// Responses made up by an interceptor still need the request they answer,
+			// a body and headers
+			if resp.Request == nil {
+				resp.Request = req
+			}
+			if resp.Body == nil {
+				resp.Body = http.NoBody
+			}
+			if resp.Header == nil {
+				resp.Header = http.Header{}
+			}
+			return resp, nil
+		}
+	}
+	return do
+}
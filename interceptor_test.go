@@ -0,0 +1,51 @@
+package gluahttp
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// A response made up by an interceptor may leave Body and Header nil
+func TestInterceptorBareResponse(t *testing.T) {
+	config := defaultConfig()
+	config.Interceptors = []Interceptor{
+		func(req *http.Request, next RoundTripFunc) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusForbidden}, nil
+		},
+	}
+	module := New(nil, config)
+
+	tests := []struct {
+		name   string
+		loader lua.LGFunction
+		source string
+	}{
+		{"sync", module.Loader, `
+			local http = require("http")
+			local resp = assert(http.get("http://example.invalid/"))
+			assert(resp.status_code == 403 and resp.body == "", resp.body)
+		`},
+		{"future", module.AsyncLoader, `
+			local http = require("http")
+			local resp = assert(http.get("http://example.invalid/"):wait())
+			assert(resp.status_code == 403 and resp.body == "", resp.body)
+		`},
+		{"batch", module.Loader, `
+			local http = require("http")
+			local resps, errs = http.batch({{url = "http://example.invalid/"}})
+			assert(errs[1] == nil, tostring(errs[1]))
+			assert(resps[1].status_code == 403 and resps[1].body == "", resps[1].body)
+		`},
+	}
+
+	for _, test := range tests {
+		L := lua.NewState()
+		L.PreloadModule("http", test.loader)
+		if err := L.DoString(test.source); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		L.Close()
+	}
+}
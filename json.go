@@ -0,0 +1,223 @@
+package gluahttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const nullRegistryKey = "gluahttp.null"
+
+// jsonNull is stored in the http.null userdata, it stands for the json null
+// value because nil can't be kept in a lua table
+type jsonNull struct{}
+
+var errJSONNesting = errors.New("cannot encode recursive table to json")
+
+// luaNull returns the http.null sentinel of the state, it is created once per
+// state so it can be compared with == in lua
+func luaNull(L *lua.LState) lua.LValue {
+	registry := L.Get(lua.RegistryIndex).(*lua.LTable)
+	if null := registry.RawGetString(nullRegistryKey); null != lua.LNil {
+		return null
+	}
+
+	null := L.NewUserData()
+	null.Value = jsonNull{}
+	registry.RawSetString(nullRegistryKey, null)
+	return null
+}
+
+// encodeJSON serializes a lua value, tables whose keys are exactly 1..n are
+// encoded as arrays and all other tables as objects
+func encodeJSON(value lua.LValue) ([]byte, error) {
+	v, err := luaToGo(value, map[*lua.LTable]bool{})
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func luaToGo(value lua.LValue, visited map[*lua.LTable]bool) (interface{}, error) {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LString:
+		return string(v), nil
+	case lua.LNumber:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("cannot encode %v to json", f)
+		}
+		return f, nil
+	case *lua.LUserData:
+		if _, ok := v.Value.(jsonNull); ok {
+			return nil, nil
+		}
+	case *lua.LTable:
+		if visited[v] {
+			return nil, errJSONNesting
+		}
+		visited[v] = true
+		defer delete(visited, v)
+
+		if n := arrayLength(v); n > 0 {
+			return arrayToGo(v, n, visited)
+		}
+		return objectToGo(v, visited)
+	}
+
+	return nil, fmt.Errorf("cannot encode %s to json", value.Type().String())
+}
+
+// arrayLength returns the length of the table if its keys are exactly 1..n,
+// otherwise 0
+func arrayLength(table *lua.LTable) int {
+	count, max := 0, 0
+	table.ForEach(func(key, value lua.LValue) {
+		count++
+		if max < 0 {
+			return
+		}
+		n, ok := key.(lua.LNumber)
+		if !ok || n < 1 || float64(n) != math.Floor(float64(n)) {
+			max = -1
+			return
+		}
+		if int(n) > max {
+			max = int(n)
+		}
+	})
+
+	if max != count {
+		return 0
+	}
+	return max
+}
+
+func arrayToGo(table *lua.LTable, n int, visited map[*lua.LTable]bool) (interface{}, error) {
+	array := make([]interface{}, n)
+	for i := range array {
+		v, err := luaToGo(table.RawGetInt(i+1), visited)
+		if err != nil {
+			return nil, err
+		}
+		array[i] = v
+	}
+	return array, nil
+}
+
+func objectToGo(table *lua.LTable, visited map[*lua.LTable]bool) (interface{}, error) {
+	var err error
+	object := map[string]interface{}{}
+	table.ForEach(func(key, value lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		var name string
+		switch k := key.(type) {
+		case lua.LString:
+			name = string(k)
+		case lua.LNumber:
+			name = strconv.FormatFloat(float64(k), 'f', -1, 64)
+		default:
+			err = fmt.Errorf("cannot encode %s as json object key", key.Type().String())
+			return
+		}
+
+		object[name], err = luaToGo(value, visited)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// decodeJSON converts a json document into lua values, json null becomes
+// http.null. With bigIntAsString integers which can't be represented exactly
+// by a lua number are kept as strings
+func decodeJSON(L *lua.LState, data string, bigIntAsString bool) (lua.LValue, error) {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return lua.LNil, jsonError(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return lua.LNil, fmt.Errorf("invalid json: unexpected data after top-level value at offset %d", decoder.InputOffset())
+	}
+
+	return goToLua(L, v, bigIntAsString), nil
+}
+
+func jsonError(err error) error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return fmt.Errorf("invalid json: %s at offset %d", e.Error(), e.Offset)
+	case *json.UnmarshalTypeError:
+		return fmt.Errorf("invalid json: %s at offset %d", e.Error(), e.Offset)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("invalid json: unexpected end of input")
+	}
+	return fmt.Errorf("invalid json: %s", err.Error())
+}
+
+func goToLua(L *lua.LState, value interface{}, bigIntAsString bool) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return luaNull(L)
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case json.Number:
+		return jsonNumber(v, bigIntAsString)
+	case []interface{}:
+		table := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			table.Append(goToLua(L, item, bigIntAsString))
+		}
+		return table
+	case map[string]interface{}:
+		table := L.CreateTable(0, len(v))
+		for key, item := range v {
+			table.RawSetString(key, goToLua(L, item, bigIntAsString))
+		}
+		return table
+	}
+	return lua.LNil
+}
+
+// maxSafeInteger is the largest integer a float64 holds without losing precision
+const maxSafeInteger = 1 << 53
+
+func jsonNumber(n json.Number, bigIntAsString bool) lua.LValue {
+	if bigIntAsString && !strings.ContainsAny(n.String(), ".eE") {
+		i, err := strconv.ParseInt(n.String(), 10, 64)
+		if err != nil || i > maxSafeInteger || i < -maxSafeInteger {
+			return lua.LString(n.String())
+		}
+	}
+
+	f, _ := n.Float64()
+	return lua.LNumber(f)
+}
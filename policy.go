@@ -0,0 +1,237 @@
+package gluahttp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DialPolicy restricts the destinations the scripts can connect to. It's checked
+// against the IP actually dialed, after the DNS resolution, so that DNS rebinding
+// and redirects can't get around it.
+//
+// DenyCIDRs win over AllowCIDRs, which win over the Block flags. When AllowCIDRs
+// isn't empty only the addresses it contains can be reached
+type DialPolicy struct {
+	// AllowCIDRs and DenyCIDRs are CIDRs or single IPs
+	AllowCIDRs []string
+	DenyCIDRs  []string
+
+	// BlockedPorts can't be connected to
+	BlockedPorts []int
+
+	// BlockLoopback blocks 127.0.0.0/8, ::1 and the unspecified addresses
+	BlockLoopback bool
+
+	// BlockLinkLocal blocks 169.254.0.0/16 and fe80::/10, which hold the cloud
+	// metadata services
+	BlockLinkLocal bool
+
+	// BlockPrivate blocks the RFC 1918 and RFC 4193 ranges
+	BlockPrivate bool
+
+	// AllowedSchemes are the URL schemes the scripts can request, every scheme
+	// is allowed when empty
+	AllowedSchemes []string
+}
+
+// dialPolicy is the parsed DialPolicy, err is set when the policy is invalid and
+// then every request fails
+type dialPolicy struct {
+	policy  DialPolicy
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	ports   map[int]bool
+	schemes map[string]bool
+	err     error
+}
+
+func newDialPolicy(policy *DialPolicy) *dialPolicy {
+	if policy == nil {
+		return nil
+	}
+
+	p := &dialPolicy{
+		policy:  *policy,
+		ports:   map[int]bool{},
+		schemes: map[string]bool{},
+	}
+	var err error
+	p.allow, err = parseCIDRs(policy.AllowCIDRs)
+	if err == nil {
+		p.deny, err = parseCIDRs(policy.DenyCIDRs)
+	}
+	if err != nil {
+		p.err = &requestError{Kind: KindBlocked, Message: err.Error(), Op: "dial", Err: err}
+	}
+	for _, port := range policy.BlockedPorts {
+		p.ports[port] = true
+	}
+	for _, scheme := range policy.AllowedSchemes {
+		p.schemes[strings.ToLower(scheme)] = true
+	}
+	return p
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid dial policy address %s", cidr)
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dial policy CIDR %s", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func blockedError(address string, reason string) error {
+	return &requestError{
+		Kind:    KindBlocked,
+		Message: fmt.Sprintf("connection to %s blocked: %s", address, reason),
+		Op:      "dial",
+		Err:     fmt.Errorf("%s: %s", address, reason),
+	}
+}
+
+// checkIP tells whether ip:port can be connected to
+func (p *dialPolicy) checkIP(ip net.IP, port int) error {
+	if p.err != nil {
+		return p.err
+	}
+
+	address := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	if p.ports[port] {
+		return blockedError(address, "port is blocked")
+	}
+	if containsIP(p.deny, ip) {
+		return blockedError(address, "address is denied")
+	}
+	if containsIP(p.allow, ip) {
+		return nil
+	}
+	if len(p.allow) > 0 {
+		return blockedError(address, "address is not allowed")
+	}
+	if p.policy.BlockLoopback && (ip.IsLoopback() || ip.IsUnspecified()) {
+		return blockedError(address, "loopback address")
+	}
+	if p.policy.BlockLinkLocal && (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()) {
+		return blockedError(address, "link-local address")
+	}
+	if p.policy.BlockPrivate && ip.IsPrivate() {
+		return blockedError(address, "private address")
+	}
+	return nil
+}
+
+// checkAddress checks an ip:port address
+func (p *dialPolicy) checkAddress(address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return blockedError(address, "address is not an IP")
+	}
+	return p.checkIP(ip, port)
+}
+
+// control is the net.Dialer Control hook, it's called with the resolved address
+// right before connecting whatever resolved it
+func (p *dialPolicy) control(network, address string, _ syscall.RawConn) error {
+	return p.checkAddress(address)
+}
+
+func (p *dialPolicy) checkScheme(scheme string) error {
+	if p.err != nil {
+		return p.err
+	}
+	if len(p.schemes) > 0 && !p.schemes[strings.ToLower(scheme)] {
+		return &requestError{
+			Kind:    KindBlocked,
+			Message: fmt.Sprintf("scheme %s is not allowed", scheme),
+			Op:      "request",
+			Err:     fmt.Errorf("scheme %s is not allowed", scheme),
+		}
+	}
+	return nil
+}
+
+// policyTransport checks every hop of a request before it's sent. Requests sent
+// through a proxy are only dialed to the proxy, their destination is resolved
+// here to be checked as well, the proxy may still resolve it differently
+type policyTransport struct {
+	transport http.RoundTripper
+	module    *httpModule
+	ro        requestOptions
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	policy := t.module.policy
+	if err := policy.checkScheme(req.URL.Scheme); err != nil {
+		return nil, err
+	}
+
+	if t.proxied(req) {
+		if err := t.module.checkDestination(req.Context(), req.URL); err != nil {
+			return nil, err
+		}
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// proxied reports whether the destination of req is resolved by a proxy, socks5
+// resolves it locally and is checked by the dialer
+func (t *policyTransport) proxied(req *http.Request) bool {
+	if proxyURL := t.ro.proxyFor(req); proxyURL != nil && isSocksProxy(proxyURL) {
+		return proxyURL.Scheme == "socks5h"
+	}
+	proxyURL, _ := t.ro.httpProxy(req)
+	return proxyURL != nil
+}
+
+// checkDestination resolves the host of u to check it when a proxy connects to it
+func (self *httpModule) checkDestination(ctx context.Context, u *url.URL) error {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	ip, err := self.lookupIP(ctx, u.Hostname())
+	if err != nil {
+		return err
+	}
+	return self.policy.checkAddress(net.JoinHostPort(ip, port))
+}
@@ -0,0 +1,175 @@
+package gluahttp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// socksProxyKey is the context key of the socks proxy the dialer has to go
+// through for the current request
+type socksProxyKey struct{}
+
+// tunnelProxyKey is the context key of the http or https proxy the dialer opens
+// a CONNECT tunnel through for the current https request
+type tunnelProxyKey struct{}
+
+// dialFunc adapts a dial function to the proxy.Dialer and proxy.ContextDialer interfaces
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialFunc) Dial(network, address string) (net.Conn, error) {
+	return f(context.Background(), network, address)
+}
+
+func (f dialFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+func isSocksProxy(proxyURL *url.URL) bool {
+	return proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h"
+}
+
+// parseNoProxy accepts a comma separated string like the NO_PROXY environment
+// variable, entries are host names, domain suffixes, IPs, CIDRs or *
+func parseNoProxy(value string) []string {
+	var hosts []string
+	for _, host := range strings.Split(value, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// bypassProxy reports whether host matches the no_proxy list
+func (ro requestOptions) bypassProxy(host string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range ro.NoProxy {
+		if entry == "*" || entry == host {
+			return true
+		}
+
+		if ip != nil {
+			if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyFor returns the proxy configured for the scheme of the request,
+// nil means the request is sent directly or with the proxy from the environment
+func (ro requestOptions) proxyFor(req *http.Request) *url.URL {
+	if ro.bypassProxy(req.URL.Hostname()) {
+		return nil
+	}
+	return ro.Proxies[req.URL.Scheme]
+}
+
+// tunnelFor returns the http or https proxy of an https request, nil when the
+// request isn't sent through one
+func (ro requestOptions) tunnelFor(req *http.Request) *url.URL {
+	if req.URL.Scheme != "https" {
+		return nil
+	}
+	proxyURL, _ := ro.httpProxy(req)
+	return proxyURL
+}
+
+// proxyTransport hands the proxy chosen for each request to the dialer of the
+// transport when it's a socks proxy or an http proxy tunnelling an https request.
+// The dialer opens the tunnels itself so that the TLS connection is its own and
+// the wireConn sees the plain requests, http.Transport only handles the plain
+// http requests sent to http and https proxies
+type proxyTransport struct {
+	transport http.RoundTripper
+	ro        requestOptions
+}
+
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if proxyURL := t.ro.proxyFor(req); proxyURL != nil && isSocksProxy(proxyURL) {
+		req = req.WithContext(context.WithValue(req.Context(), socksProxyKey{}, proxyURL))
+	} else if proxyURL := t.ro.tunnelFor(req); proxyURL != nil {
+		req = req.WithContext(context.WithValue(req.Context(), tunnelProxyKey{}, proxyURL))
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// dialSocks connects to address through the socks proxy, the proxy itself is
+// reached with the direct dialer. socks5 resolves the target locally (through
+// the dns cache when there is one) while socks5h lets the proxy resolve it
+func (self *httpModule) dialSocks(ctx context.Context, proxyURL *url.URL, network, address string, direct dialFunc) (net.Conn, error) {
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "1080")
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, direct)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL.Scheme == "socks5" {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		ip, err := self.lookupIP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		address = net.JoinHostPort(ip, port)
+
+		// The dialer only sees the address of the proxy
+		if self.policy != nil {
+			if err := self.policy.checkAddress(address); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("socks dialer does not support contexts")
+	}
+	return contextDialer.DialContext(ctx, network, address)
+}
+
+func (self *httpModule) lookupIP(ctx context.Context, host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+
+	if self.resolver != nil {
+		return self.fetchIP(ctx, host)
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs[0].IP.String(), nil
+}
@@ -0,0 +1,326 @@
+package gluahttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// Quota limits what the scripts of a lua state can do with the module, zero
+// values are unlimited
+type Quota struct {
+	// MaxRequests is the number of requests the state can send, every redirect
+	// and every retry counts as a request
+	MaxRequests int64
+
+	// MaxConcurrent is the number of requests in flight at the same time, a
+	// request is in flight until its response body is closed
+	MaxConcurrent int
+
+	// MaxDownloadBytes is the total size of the response bodies read
+	MaxDownloadBytes int64
+
+	// MaxUploadBytes is the total size of the request bodies sent
+	MaxUploadBytes int64
+
+	// MaxTime is the wall time spent with at least one request in flight
+	MaxTime time.Duration
+}
+
+// Usage is what a lua state used so far
+type Usage struct {
+	Requests      int64
+	Concurrent    int
+	DownloadBytes int64
+	UploadBytes   int64
+	Time          time.Duration
+}
+
+// stateQuota tracks the usage of a lua state and its coroutines, it's shared by
+// the goroutines sending the async requests of the state
+type stateQuota struct {
+	mu    sync.Mutex
+	quota Quota
+	usage Usage
+
+	// since is when the state went from no request in flight to one
+	since time.Time
+}
+
+// quotaFor returns the quota of the state, nil when neither Config.Quota nor
+// SetQuota asked to track it
+func (self *httpModule) quotaFor(L *lua.LState) *stateQuota {
+	self.quotaMu.Lock()
+	defer self.quotaMu.Unlock()
+
+	q, ok := self.quotas[L.G]
+	if !ok && self.config.Quota != nil {
+		q = &stateQuota{quota: *self.config.Quota}
+		self.quotas[L.G] = q
+	}
+	return q
+}
+
+// SetQuota sets the quota of L in place of Config.Quota, the usage is kept.
+// A zero Quota tracks the usage without limiting it
+func (self *httpModule) SetQuota(L *lua.LState, quota Quota) {
+	self.quotaMu.Lock()
+	defer self.quotaMu.Unlock()
+
+	q, ok := self.quotas[L.G]
+	if !ok {
+		q = &stateQuota{}
+		self.quotas[L.G] = q
+	}
+	q.mu.Lock()
+	q.quota = quota
+	q.mu.Unlock()
+}
+
+// Usage returns what L used so far
+func (self *httpModule) Usage(L *lua.LState) Usage {
+	self.quotaMu.Lock()
+	q := self.quotas[L.G]
+	self.quotaMu.Unlock()
+
+	if q == nil {
+		return Usage{}
+	}
+	return q.current()
+}
+
+// Release stops tracking L and returns what it used, it has to be called once
+// the state is closed when quotas are used
+func (self *httpModule) Release(L *lua.LState) Usage {
+	self.quotaMu.Lock()
+	q := self.quotas[L.G]
+	delete(self.quotas, L.G)
+	self.quotaMu.Unlock()
+
+	if q == nil {
+		return Usage{}
+	}
+	return q.current()
+}
+
+func quotaError(urlStr string, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+	return &requestError{
+		Kind:    KindQuotaExceeded,
+		Message: message,
+		URL:     urlStr,
+		Op:      "quota",
+		Err:     errors.New(message),
+	}
+}
+
+func (q *stateQuota) current() Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage := q.usage
+	usage.Time = q.elapsed(time.Now())
+	return usage
+}
+
+// elapsed is the time spent with requests in flight, q.mu must be held
+func (q *stateQuota) elapsed(now time.Time) time.Duration {
+	elapsed := q.usage.Time
+	if q.usage.Concurrent > 0 {
+		elapsed += now.Sub(q.since)
+	}
+	return elapsed
+}
+
+// begin reserves a request and returns the time it has left, zero when the
+// time isn't limited. Requests without a body can still be sent once the upload
+// quota is used
+func (q *stateQuota) begin(urlStr string, upload bool) (time.Duration, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case q.quota.MaxRequests > 0 && q.usage.Requests >= q.quota.MaxRequests:
+		return 0, quotaError(urlStr, "quota of %d requests exceeded", q.quota.MaxRequests)
+	case q.quota.MaxConcurrent > 0 && q.usage.Concurrent >= q.quota.MaxConcurrent:
+		return 0, quotaError(urlStr, "quota of %d concurrent requests exceeded", q.quota.MaxConcurrent)
+	case q.quota.MaxDownloadBytes > 0 && q.usage.DownloadBytes >= q.quota.MaxDownloadBytes:
+		return 0, quotaError(urlStr, "download quota of %d bytes exceeded", q.quota.MaxDownloadBytes)
+	case upload && q.quota.MaxUploadBytes > 0 && q.usage.UploadBytes >= q.quota.MaxUploadBytes:
+		return 0, quotaError(urlStr, "upload quota of %d bytes exceeded", q.quota.MaxUploadBytes)
+	case q.quota.MaxTime > 0 && q.elapsed(now) >= q.quota.MaxTime:
+		return 0, quotaError(urlStr, "time quota of %s exceeded", q.quota.MaxTime)
+	}
+
+	var remaining time.Duration
+	if q.quota.MaxTime > 0 {
+		remaining = q.quota.MaxTime - q.elapsed(now)
+	}
+
+	q.usage.Requests++
+	if q.usage.Concurrent == 0 {
+		q.since = now
+	}
+	q.usage.Concurrent++
+	return remaining, nil
+}
+
+func (q *stateQuota) timeExceeded(urlStr string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return quotaError(urlStr, "time quota of %s exceeded", q.quota.MaxTime)
+}
+
+func (q *stateQuota) end() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.usage.Concurrent--
+	if q.usage.Concurrent == 0 {
+		q.usage.Time += time.Since(q.since)
+	}
+}
+
+// take counts n bytes of a body and returns how many of them fit in the quota
+func (q *stateQuota) take(urlStr string, upload bool, n int) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	name, used, max := "download", &q.usage.DownloadBytes, q.quota.MaxDownloadBytes
+	if upload {
+		name, used, max = "upload", &q.usage.UploadBytes, q.quota.MaxUploadBytes
+	}
+
+	if max > 0 && *used+int64(n) > max {
+		allowed := max - *used
+		*used = max
+		return int(allowed), quotaError(urlStr, "%s quota of %d bytes exceeded", name, max)
+	}
+	*used += int64(n)
+	return n, nil
+}
+
+// quotaTransport counts every hop of a request against the quota of the state
+// which made it. err is the first quota error of the request, the client and
+// the body readers don't always return it as is
+type quotaTransport struct {
+	transport http.RoundTripper
+	quota     *stateQuota
+
+	mu  sync.Mutex
+	err error
+}
+
+func (t *quotaTransport) fail(err error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.err == nil {
+		t.err = err
+	}
+	return t.err
+}
+
+// exceeded returns the quota error of the request, if any
+func (t *quotaTransport) exceeded() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+func (t *quotaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	urlStr := req.URL.String()
+	upload := req.Body != nil && req.Body != http.NoBody
+	remaining, err := t.quota.begin(urlStr, upload)
+	if err != nil {
+		return nil, t.fail(err)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	hop := &quotaHop{transport: t, url: urlStr, cancel: cancel}
+	if remaining > 0 {
+		hop.timer = time.AfterFunc(remaining, func() {
+			t.fail(t.quota.timeExceeded(urlStr))
+			cancel()
+		})
+	}
+
+	req = req.WithContext(ctx)
+	if upload {
+		req.Body = &quotaBody{ReadCloser: req.Body, hop: hop, upload: true}
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		hop.end()
+		if exceeded := t.exceeded(); exceeded != nil {
+			return nil, exceeded
+		}
+		return nil, err
+	}
+
+	resp.Body = &quotaBody{ReadCloser: resp.Body, hop: hop}
+	return resp, nil
+}
+
+// quotaHop is a single request in flight, it ends when its response body is closed
+type quotaHop struct {
+	transport *quotaTransport
+	url       string
+	cancel    context.CancelFunc
+	timer     *time.Timer
+	once      sync.Once
+}
+
+func (h *quotaHop) end() {
+	h.once.Do(func() {
+		if h.timer != nil {
+			h.timer.Stop()
+		}
+		h.cancel()
+		h.transport.quota.end()
+	})
+}
+
+// quotaBody counts the bytes read from a request or a response body
+type quotaBody struct {
+	io.ReadCloser
+	hop    *quotaHop
+	upload bool
+}
+
+func (b *quotaBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		var exceeded error
+		if n, exceeded = b.hop.transport.quota.take(b.hop.url, b.upload, n); exceeded != nil {
+			return n, b.hop.transport.fail(exceeded)
+		}
+	}
+	if err != nil && err != io.EOF {
+		if exceeded := b.hop.transport.exceeded(); exceeded != nil {
+			return n, exceeded
+		}
+	}
+	return n, err
+}
+
+// Close ends the request with its response body, the transport closes the
+// request body on its own
+func (b *quotaBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.upload {
+		b.hop.end()
+	}
+	return err
+}
@@ -0,0 +1,351 @@
+package gluahttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// doRaw writes data as is to host:port and reads the reply, it returns
+// { raw = "", raw_truncated = false, response = {}, parse_error = "" } where
+// response is the reply parsed as an HTTP response when it could be
+func (self *httpModule) doRaw(L *lua.LState, host string, port int, data string, options *lua.LTable) (lua.LValue, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+
+	ro, err := parseOptions(options, self.config)
+	if err != nil {
+		return lua.LNil, newRequestError(KindInvalidOptions, address, err)
+	}
+	defer ro.CloseFiles()
+
+	var useTLS, readAll bool
+	if options != nil {
+		useTLS = lua.LVAsBool(options.RawGetString("tls"))
+		readAll = lua.LVAsBool(options.RawGetString("read_all"))
+	}
+
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	urlStr := scheme + "://" + address
+	if self.policy != nil {
+		if err := self.policy.checkScheme(scheme); err != nil {
+			return lua.LNil, err
+		}
+	}
+
+	ctx := context.Background()
+	if L.Context() != nil {
+		ctx = L.Context()
+	}
+
+	var quotaCtx context.Context
+	if q := self.quotaFor(L); q != nil {
+		remaining, err := q.begin(urlStr, data != "")
+		if err != nil {
+			return lua.LNil, err
+		}
+		defer q.end()
+
+		if remaining > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, remaining)
+			defer cancel()
+			quotaCtx = ctx
+		}
+		if _, err := q.take(urlStr, true, len(data)); err != nil {
+			return lua.LNil, err
+		}
+	}
+
+	// fail tells apart the cancellation of the state and the end of the time quota
+	fail := func(err error) error {
+		if quotaCtx != nil && quotaCtx.Err() != nil && (L.Context() == nil || L.Context().Err() == nil) {
+			return self.quotaFor(L).timeExceeded(urlStr)
+		}
+		if ctx.Err() != nil {
+			return &requestError{Kind: KindCanceled, Message: err.Error(), URL: urlStr, Op: "raw", Err: err}
+		}
+		return &url.Error{Op: "Raw", URL: urlStr, Err: err}
+	}
+
+	conn, err := self.dialRaw(ctx, ro, scheme, host, address)
+	if err != nil {
+		return lua.LNil, fail(err)
+	}
+	defer conn.Close()
+
+	// Closing the connection unblocks the reads when the state is canceled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if _, err := io.WriteString(conn, data); err != nil {
+		return lua.LNil, fail(err)
+	}
+
+	var reply io.Reader = conn
+	if q := self.quotaFor(L); q != nil {
+		reply = &quotaReader{reader: reply, quota: q, url: urlStr}
+	}
+	if ro.MaxBodySize > 0 {
+		reply = io.LimitReader(reply, ro.MaxBodySize+1)
+	}
+
+	var raw bytes.Buffer
+	source := &rawReader{reader: reply}
+	tee := io.TeeReader(source, &raw)
+	method := rawRequestMethod(data)
+
+	// The first response ends the read unless read_all waits for the connection
+	// to be closed or idle for the timeout. A reply which isn't valid HTTP is read
+	// the same way
+	var resp *http.Response
+	var body []byte
+	var parseErr error
+	if !readAll {
+		resp, body, parseErr = readRawResponse(bufio.NewReader(tee), method)
+	}
+	if readAll || (parseErr != nil && source.err == nil) {
+		io.Copy(ioutil.Discard, tee)
+	}
+	if resp == nil {
+		resp, body, parseErr = readRawResponse(bufio.NewReader(bytes.NewReader(raw.Bytes())), method)
+	}
+
+	readErr := source.err
+	var exceeded *requestError
+	if errors.As(readErr, &exceeded) && exceeded.Kind == KindQuotaExceeded {
+		return lua.LNil, readErr
+	}
+	if ctx.Err() != nil {
+		return lua.LNil, fail(ctx.Err())
+	}
+	if raw.Len() == 0 {
+		if readErr == nil {
+			readErr = io.EOF
+		}
+		return lua.LNil, fail(readErr)
+	}
+
+	truncated := ro.MaxBodySize > 0 && int64(raw.Len()) > ro.MaxBodySize
+	if truncated {
+		raw.Truncate(int(ro.MaxBodySize))
+	}
+
+	result := L.NewTable()
+	result.RawSetString("raw", lua.LString(raw.String()))
+	result.RawSetString("raw_truncated", lua.LBool(truncated))
+	if resp != nil {
+		result.RawSetString("response", rawResponse(L, resp, body))
+	} else {
+		result.RawSetString("parse_error", lua.LString(parseErr.Error()))
+	}
+	return result, nil
+}
+
+// dialRaw connects to address like the transports do, through the proxy of
+// the scheme. http and https proxies are asked for a CONNECT tunnel
+func (self *httpModule) dialRaw(ctx context.Context, ro *requestOptions, scheme, host, address string) (net.Conn, error) {
+	dial := self.dialer(*ro)
+
+	var proxyURL *url.URL
+	if !ro.bypassProxy(host) {
+		proxyURL = ro.Proxies[scheme]
+	}
+
+	// The proxy resolves the destination, it's checked here like for the requests
+	if self.policy != nil && proxyURL != nil && proxyURL.Scheme != "socks5" {
+		if err := self.checkDestination(ctx, &url.URL{Scheme: scheme, Host: address}); err != nil {
+			return nil, err
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	switch {
+	case proxyURL == nil:
+		conn, err = dial(ctx, "tcp", address)
+	case isSocksProxy(proxyURL):
+		conn, err = dial(context.WithValue(ctx, socksProxyKey{}, proxyURL), "tcp", address)
+	default:
+		conn, err = dialTunnel(ctx, dial, proxyURL, address, ro)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme != "https" {
+		return conn, nil
+	}
+
+	config := ro.tlsConfig()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialTunnel opens a CONNECT tunnel to address through an http or https proxy,
+// its errors are proxyconnect ones like those of http.Transport
+func dialTunnel(ctx context.Context, dial dialFunc, proxyURL *url.URL, address string, ro *requestOptions) (net.Conn, error) {
+	conn, err := connectTunnel(ctx, dial, proxyURL, address, ro)
+	if err != nil {
+		return nil, &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
+	}
+	return conn, nil
+}
+
+func connectTunnel(ctx context.Context, dial dialFunc, proxyURL *url.URL, address string, ro *requestOptions) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	conn, err := dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname(), InsecureSkipVerify: ro.InsecureSkipVerify})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	connect := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		connect.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := connect.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The proxy sends nothing after its response until the tunnel is used, the
+	// reader can't have buffered any byte of the destination. A 2xx response to
+	// CONNECT has no body whatever its headers say, so it's left unread
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connect)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("proxy refused the tunnel: " + resp.Status)
+	}
+	return conn, nil
+}
+
+// rawRequestMethod is the method of the hand-crafted request, a response to a
+// HEAD request has no body
+func rawRequestMethod(data string) string {
+	if i := strings.IndexByte(data, ' '); i > 0 {
+		return data[:i]
+	}
+	return "GET"
+}
+
+// readRawResponse parses the first final response, 1xx interim responses are skipped
+func readRawResponse(reader *bufio.Reader, method string) (*http.Response, []byte, error) {
+	req := &http.Request{Method: method}
+	for {
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, body, nil
+		}
+	}
+}
+
+// rawResponse describes a parsed reply:
+// { status_code = 200, status = "200 OK", proto = "HTTP/1.1", headers = {}, cookies = {}, body = "" }
+func rawResponse(L *lua.LState, resp *http.Response, body []byte) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("status_code", lua.LNumber(resp.StatusCode))
+	table.RawSetString("status", lua.LString(resp.Status))
+	table.RawSetString("proto", lua.LString(resp.Proto))
+	table.RawSetString("headers", getHeaders(L, resp.Header))
+	table.RawSetString("cookies", getCookies(L, resp.Cookies()))
+	table.RawSetString("body", lua.LString(body))
+	return table
+}
+
+// rawReader keeps the first error of the reads, the parser hides it
+type rawReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *rawReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// quotaReader counts the bytes of a raw reply against the download quota
+type quotaReader struct {
+	reader io.Reader
+	quota  *stateQuota
+	url    string
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		var exceeded error
+		if n, exceeded = r.quota.take(r.url, false, n); exceeded != nil {
+			return n, exceeded
+		}
+	}
+	return n, err
+}
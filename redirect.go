@@ -0,0 +1,188 @@
+package gluahttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// maxRedirects is the number of redirects followed before giving up when the
+// script doesn't set max_redirects
+const maxRedirects = 10
+
+var errTooManyRedirects = errors.New("too many redirects")
+
+// bodyHeaders describe the body, they are dropped by the client along with the
+// body when a redirect turns a POST into a GET
+var bodyHeaders = []string{"Content-Type", "Content-Encoding", "Content-Language", "Content-Location"}
+
+// sensitiveHeaders are removed by redirect_strip_auth_cross_host
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Cookie2"}
+
+// redirectLogKey is the context key of the redirectLog of the current request,
+// redirected requests keep the context of the first one
+type redirectLogKey struct{}
+
+// redirectDecision is what was done with a redirect response, it's exposed as
+// the redirect field of the response
+type redirectDecision struct {
+	Followed     bool
+	Reason       string
+	Location     string
+	Method       string
+	AuthStripped bool
+}
+
+func (d *redirectDecision) table(L *lua.LState) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("followed", lua.LBool(d.Followed))
+	table.RawSetString("reason", lua.LString(d.Reason))
+	table.RawSetString("location", lua.LString(d.Location))
+	table.RawSetString("method", lua.LString(d.Method))
+	table.RawSetString("auth_stripped", lua.LBool(d.AuthStripped))
+	return table
+}
+
+// redirectLog records the decision taken for every redirect response of a request
+type redirectLog struct {
+	mu        sync.Mutex
+	decisions map[*http.Response]*redirectDecision
+}
+
+func withRedirectLog(req *http.Request) *http.Request {
+	log := &redirectLog{decisions: map[*http.Response]*redirectDecision{}}
+	return req.WithContext(context.WithValue(req.Context(), redirectLogKey{}, log))
+}
+
+func redirectLogFrom(ctx context.Context) *redirectLog {
+	log, _ := ctx.Value(redirectLogKey{}).(*redirectLog)
+	return log
+}
+
+func (l *redirectLog) record(resp *http.Response, decision *redirectDecision) {
+	if l == nil || resp == nil {
+		return
+	}
+	l.mu.Lock()
+	l.decisions[resp] = decision
+	l.mu.Unlock()
+}
+
+// stop changes the decision for resp once a lua callback refused the redirect
+func (l *redirectLog) stop(resp *http.Response, reason string) {
+	if l == nil || resp == nil {
+		return
+	}
+	l.mu.Lock()
+	if decision, ok := l.decisions[resp]; ok {
+		decision.Followed = false
+		decision.Reason = reason
+	}
+	l.mu.Unlock()
+}
+
+func (l *redirectLog) decision(resp *http.Response) *redirectDecision {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.decisions[resp]
+}
+
+// checkRedirect applies the redirect options to req, the next request of the
+// redirect chain. http.ErrUseLastResponse stops at the redirect response
+func (ro requestOptions) checkRedirect(req *http.Request, via []*http.Request) (*redirectDecision, error) {
+	first := via[0]
+	decision := &redirectDecision{Location: req.URL.String(), Method: req.Method}
+
+	if ro.DisableRedirect {
+		decision.Reason = "disabled"
+		return decision, http.ErrUseLastResponse
+	}
+
+	if len(via) > ro.MaxRedirects {
+		decision.Reason = "max_redirects"
+		return decision, &requestError{
+			Kind:    KindRedirect,
+			Message: fmt.Sprintf("stopped after %d redirects", ro.MaxRedirects),
+			URL:     req.URL.String(),
+			Op:      "redirect",
+			Err:     errTooManyRedirects,
+		}
+	}
+
+	if ro.RedirectSameHostOnly && !strings.EqualFold(req.URL.Hostname(), first.URL.Hostname()) {
+		decision.Reason = "same_host_only"
+		return decision, http.ErrUseLastResponse
+	}
+
+	// The client turns a POST into a GET on 301 and 302 and drops the body for the
+	// following hops, keep the method and the body like for 307 and 308. 303 always
+	// means the result has to be fetched with GET
+	hasBody := first.Body != nil && first.Body != http.NoBody
+	if ro.RedirectKeepMethod && req.Response.StatusCode != http.StatusSeeOther &&
+		(req.Method != first.Method || (hasBody && (req.Body == nil || req.Body == http.NoBody))) {
+		if hasBody && first.GetBody == nil {
+			decision.Reason = "body_not_replayable"
+			return decision, http.ErrUseLastResponse
+		}
+
+		req.Method = first.Method
+		if first.GetBody != nil {
+			body, err := first.GetBody()
+			if err != nil {
+				return decision, err
+			}
+			req.Body = body
+			req.GetBody = first.GetBody
+			req.ContentLength = first.ContentLength
+		}
+		for _, name := range bodyHeaders {
+			if values, ok := first.Header[name]; ok {
+				req.Header[name] = values
+			}
+		}
+		decision.Method = req.Method
+	}
+
+	if ro.RedirectStripAuthCrossHost && req.URL.Host != first.URL.Host {
+		for _, name := range sensitiveHeaders {
+			if _, ok := req.Header[name]; ok {
+				req.Header.Del(name)
+				decision.AuthStripped = true
+			}
+		}
+	}
+
+	decision.Followed = true
+	return decision, nil
+}
+
+// luaRedirect calls the redirect callback and the on_redirect hook once the
+// redirect options allowed the redirect, it runs on the state which made the request
+func (ro requestOptions) luaRedirect(L *lua.LState, req *http.Request) error {
+	log := redirectLogFrom(req.Context())
+
+	if ro.RedirectCallback != nil {
+		stopped, err := callHook(L, "redirect", ro.RedirectCallback, req.URL.String(), hookRequest(L, req), redirectResponse(L, req))
+		if stopped {
+			log.stop(req.Response, "callback")
+			return http.ErrUseLastResponse
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err := ro.Hooks.redirect(L, req)
+	if err == http.ErrUseLastResponse {
+		log.stop(req.Response, "on_redirect")
+	}
+	return err
+}
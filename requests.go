@@ -2,6 +2,7 @@ package gluahttp
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -11,10 +12,12 @@ import (
 	"net"
 	"net/http"
 	"net/http/cookiejar"
+	"net/http/httptrace"
 	"net/textproto"
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -45,30 +48,58 @@ type requestOptions struct {
 
 	// Data is a map of key values that will eventually convert into the
 	// query string of a GET request or the body of a POST request.
-	Data map[string]string
+	// A key can have several values
+	Data url.Values
 
-	// Params is a map of query strings that may be used within a GET request
-	Params map[string]string
+	// Params is a map of query strings that may be used within a GET request,
+	// a key can have several values
+	Params url.Values
 
 	// Files is where you can include files to upload. The use of this data
 	// structure is limited to POST requests
 	Files []fileUpload
 
-	// JSON can be used when you wish to send JSON within the request body
+	// JSON can be used when you wish to send JSON within the request body,
+	// lua tables are serialized into it by parseOptions
 	JSON string
 
 	// XML can be used if you wish to send XML within the request body
 	XML string
 
 	// Headers if you want to add custom HTTP headers to the request,
-	// this is your friend
-	Headers map[string]string
+	// this is your friend. A header can have several values
+	Headers map[string][]string
+
+	// HeaderOrder are the names of the headers given as an array, they are
+	// written first on the wire, in that order and with that casing
+	HeaderOrder []string
+
+	// DefaultHeaders come from the module config and are overridden by Headers
+	DefaultHeaders map[string]string
+
+	// UserAgent is set when Headers has no User-Agent
+	UserAgent string
 
 	// InsecureSkipVerify is a flag that specifies if we should validate the
 	// server's TLS certificate. It should be noted that Go's TLS verify mechanism
 	// doesn't validate if a certificate has been revoked
 	InsecureSkipVerify bool
 
+	// Certificates are presented to servers requiring mutual TLS
+	Certificates []tls.Certificate
+
+	// CABundle is the PEM data of the CAs trusted instead of the system roots
+	CABundle []byte
+
+	// ServerName overrides the name sent with SNI and checked against the
+	// server certificate
+	ServerName string
+
+	// MinTLSVersion and MaxTLSVersion bound the negotiated TLS version,
+	// zero leaves the Go defaults
+	MinTLSVersion uint16
+	MaxTLSVersion uint16
+
 	// DisableCompression will disable gzip compression on requests
 	DisableCompression bool
 
@@ -89,12 +120,54 @@ type requestOptions struct {
 	// *protocol* => proxy address e.g http => http://127.0.0.1:8080
 	Proxies map[string]*url.URL
 
+	// NoProxy lists the hosts, domains and CIDRs which are requested without proxy
+	NoProxy []string
+
 	// RequestTimeout is the maximum amount of time a whole request(include dial / request / redirect)
 	// will wait.
 	Timeout time.Duration
 
 	DisableRedirect bool
 
+	// MaxRedirects is the number of redirects followed before failing
+	MaxRedirects int
+
+	// RedirectSameHostOnly stops at redirects to another host
+	RedirectSameHostOnly bool
+
+	// RedirectKeepMethod keeps the method and body of the request on 301 and 302
+	// redirects, like on 307 and 308
+	RedirectKeepMethod bool
+
+	// RedirectStripAuthCrossHost removes the credentials as soon as the redirect
+	// changes the host or the port, by default they are only kept for subdomains
+	RedirectStripAuthCrossHost bool
+
+	// RedirectCallback decides whether each redirect is followed
+	RedirectCallback *lua.LFunction
+
+	// Stream returns the body of the response as a reader instead of a string
+	Stream bool
+
+	// MaxBodySize is the maximum number of bytes of a response body kept in
+	// memory, longer bodies are truncated. Zero means no limit
+	MaxBodySize int64
+
+	// MaxRawSize is the maximum number of bytes of the request written on the
+	// wire kept in request.raw. Zero means no limit
+	MaxRawSize int64
+
+	// CaptureRaw records the bytes read from the connection for each hop, they
+	// are returned as resp.raw and capped by MaxRawSize too
+	CaptureRaw bool
+
+	// Hooks are the lua callbacks called around the request
+	Hooks *requestHooks
+
+	// Retry sends the request again on the configured errors and status codes,
+	// nil disables retries
+	Retry *retryPolicy
+
 	// RequestBody allows you to put anything matching an `io.Reader` into the request
 	// this option will take precedence over any other request option specified
 	//RequestBody io.Reader
@@ -110,15 +183,35 @@ func (ro *requestOptions) CloseFiles() {
 	}
 }
 
+// proxySettings is the Proxy of the transports, https requests are tunnelled by
+// the dialer instead
 func (ro requestOptions) proxySettings(req *http.Request) (*url.URL, error) {
+	proxyURL, err := ro.httpProxy(req)
+	if err != nil || req.URL.Scheme == "https" {
+		return nil, err
+	}
+	return proxyURL, nil
+}
+
+// httpProxy returns the http or https proxy of the request, from the options or
+// the environment
+func (ro requestOptions) httpProxy(req *http.Request) (*url.URL, error) {
+	if ro.bypassProxy(req.URL.Hostname()) {
+		return nil, nil
+	}
+
 	// No proxies – lets use the default
 	if len(ro.Proxies) == 0 {
 		return http.ProxyFromEnvironment(req)
 	}
 
 	// There was a proxy specified – do we support the protocol?
-	if _, ok := ro.Proxies[req.URL.Scheme]; ok {
-		return ro.Proxies[req.URL.Scheme], nil
+	if proxyURL, ok := ro.Proxies[req.URL.Scheme]; ok {
+		// Socks proxies are handled by the dialer of the transport
+		if isSocksProxy(proxyURL) {
+			return nil, nil
+		}
+		return proxyURL, nil
 	}
 
 	// Proxies were specified but not for any protocol that we use
@@ -141,28 +234,22 @@ func fileUploadFromDisk(fieldName, filePath string) (fileUpload, error) {
 	}, nil
 }
 
-func parseOptions(options *lua.LTable) (*requestOptions, error) {
-	var ro = new(requestOptions)
+func parseOptions(options *lua.LTable, config Config) (*requestOptions, error) {
+	var ro = &requestOptions{
+		DefaultHeaders:     config.Headers,
+		UserAgent:          config.UserAgent,
+		Timeout:            config.timeout(),
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		DisableRedirect:    config.DisableRedirect,
+		MaxRedirects:       maxRedirects,
+		DisableCompression: config.DisableCompression,
+		MaxBodySize:        config.MaxBodySize,
+		MaxRawSize:         config.maxRawSize(),
+	}
 	if options == nil {
-		ro.Timeout = 30 * time.Second
 		return ro, nil
 	}
 
-	if reqFiles, ok := options.RawGetString("files").(*lua.LTable); ok {
-		var err error
-		reqFiles.ForEach(func(fieldName, filePath lua.LValue) {
-			fu, ferr := fileUploadFromDisk(fieldName.String(), filePath.String())
-			if ferr != nil {
-				err = ferr
-				return
-			}
-			ro.Files = append(ro.Files, fu)
-		})
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	if reqProxies, ok := options.RawGetString("proxies").(*lua.LTable); ok {
 		var err error
 		ro.Proxies = map[string]*url.URL{}
@@ -179,14 +266,97 @@ func parseOptions(options *lua.LTable) (*requestOptions, error) {
 		}
 	}
 
+	switch reqNoProxy := options.RawGetString("no_proxy").(type) {
+	case lua.LString:
+		ro.NoProxy = parseNoProxy(reqNoProxy.String())
+	case *lua.LTable:
+		reqNoProxy.ForEach(func(_, host lua.LValue) {
+			ro.NoProxy = append(ro.NoProxy, parseNoProxy(host.String())...)
+		})
+	}
+
 	if reqTimeout, ok := options.RawGetString("timeout").(lua.LNumber); ok {
-		ro.Timeout = time.Duration(float64(lua.LVAsNumber(reqTimeout))) * time.Second
+		ro.Timeout = time.Duration(float64(reqTimeout) * float64(time.Second))
+	}
+
+	if reqHooks, ok := options.RawGetString("hooks").(*lua.LTable); ok {
+		hooks, err := parseHooks(reqHooks)
+		if err != nil {
+			return nil, err
+		}
+		ro.Hooks = hooks
+	}
+
+	if reqStream, ok := options.RawGetString("stream").(lua.LBool); ok {
+		ro.Stream = bool(reqStream)
+	}
+
+	if reqMaxBodySize, ok := options.RawGetString("max_body_size").(lua.LNumber); ok {
+		if reqMaxBodySize < 0 {
+			return nil, fmt.Errorf("invalid max_body_size %v", reqMaxBodySize)
+		}
+		ro.MaxBodySize = int64(reqMaxBodySize)
+	}
+
+	if reqMaxRawSize, ok := options.RawGetString("max_raw_size").(lua.LNumber); ok {
+		if reqMaxRawSize < 0 {
+			return nil, fmt.Errorf("invalid max_raw_size %v", reqMaxRawSize)
+		}
+		ro.MaxRawSize = int64(reqMaxRawSize)
+	}
+
+	if reqCaptureRaw, ok := options.RawGetString("capture_raw").(lua.LBool); ok {
+		ro.CaptureRaw = bool(reqCaptureRaw)
+	}
+
+	if reqRetry := options.RawGetString("retry"); reqRetry != lua.LNil {
+		policy, err := parseRetry(reqRetry)
+		if err != nil {
+			return nil, err
+		}
+		ro.Retry = policy
 	}
 
 	if reqVerify, ok := options.RawGetString("verify").(lua.LBool); ok {
 		ro.InsecureSkipVerify = !bool(reqVerify)
 	}
 
+	if reqCert, ok := options.RawGetString("cert").(lua.LString); ok {
+		cert, err := loadClientCertificate(reqCert.String(), lua.LVAsString(options.RawGetString("key")))
+		if err != nil {
+			return nil, err
+		}
+		ro.Certificates = []tls.Certificate{cert}
+	}
+
+	if reqCABundle, ok := options.RawGetString("ca_bundle").(lua.LString); ok {
+		bundle, err := loadCABundle(reqCABundle.String())
+		if err != nil {
+			return nil, err
+		}
+		ro.CABundle = bundle
+	}
+
+	if reqServerName, ok := options.RawGetString("server_name").(lua.LString); ok {
+		ro.ServerName = reqServerName.String()
+	}
+
+	if reqMinTLS := options.RawGetString("min_tls"); reqMinTLS != lua.LNil {
+		version, err := parseTLSVersion(reqMinTLS.String())
+		if err != nil {
+			return nil, err
+		}
+		ro.MinTLSVersion = version
+	}
+
+	if reqMaxTLS := options.RawGetString("max_tls"); reqMaxTLS != lua.LNil {
+		version, err := parseTLSVersion(reqMaxTLS.String())
+		if err != nil {
+			return nil, err
+		}
+		ro.MaxTLSVersion = version
+	}
+
 	if reqCompress, ok := options.RawGetString("compress").(lua.LBool); ok {
 		ro.DisableCompression = !bool(reqCompress)
 	}
@@ -195,8 +365,30 @@ func parseOptions(options *lua.LTable) (*requestOptions, error) {
 		ro.IsAjax = bool(reqAjax)
 	}
 
-	if reqRedirect, ok := options.RawGetString("redirect").(lua.LBool); ok {
+	switch reqRedirect := options.RawGetString("redirect").(type) {
+	case lua.LBool:
 		ro.DisableRedirect = !bool(reqRedirect)
+	case *lua.LFunction:
+		ro.RedirectCallback = reqRedirect
+	}
+
+	if reqMaxRedirects, ok := options.RawGetString("max_redirects").(lua.LNumber); ok {
+		if reqMaxRedirects < 0 {
+			return nil, fmt.Errorf("invalid max_redirects %v", reqMaxRedirects)
+		}
+		ro.MaxRedirects = int(reqMaxRedirects)
+	}
+
+	if reqSameHost, ok := options.RawGetString("redirect_same_host_only").(lua.LBool); ok {
+		ro.RedirectSameHostOnly = bool(reqSameHost)
+	}
+
+	if reqKeepMethod, ok := options.RawGetString("redirect_keep_method").(lua.LBool); ok {
+		ro.RedirectKeepMethod = bool(reqKeepMethod)
+	}
+
+	if reqStripAuth, ok := options.RawGetString("redirect_strip_auth_cross_host").(lua.LBool); ok {
+		ro.RedirectStripAuthCrossHost = bool(reqStripAuth)
 	}
 
 	if reqHost, ok := options.RawGetString("host").(lua.LString); ok {
@@ -211,10 +403,11 @@ func parseOptions(options *lua.LTable) (*requestOptions, error) {
 	}
 
 	if reqHeaders, ok := options.RawGetString("headers").(*lua.LTable); ok {
-		ro.Headers = map[string]string{}
-		reqHeaders.ForEach(func(key, value lua.LValue) {
-			ro.Headers[key.String()] = value.String()
-		})
+		headers, order, err := parseHeaders(reqHeaders)
+		if err != nil {
+			return nil, err
+		}
+		ro.Headers, ro.HeaderOrder = headers, order
 	}
 
 	if reqCookies, ok := options.RawGetString("cookies").(*lua.LTable); ok {
@@ -224,21 +417,22 @@ func parseOptions(options *lua.LTable) (*requestOptions, error) {
 	}
 
 	if reqParams, ok := options.RawGetString("params").(*lua.LTable); ok {
-		ro.Params = map[string]string{}
-		reqParams.ForEach(func(key, value lua.LValue) {
-			ro.Params[key.String()] = value.String()
-		})
+		ro.Params = luaValues(reqParams)
 	}
 
 	if reqData, ok := options.RawGetString("data").(*lua.LTable); ok {
-		ro.Data = map[string]string{}
-		reqData.ForEach(func(key, value lua.LValue) {
-			ro.Data[key.String()] = value.String()
-		})
+		ro.Data = luaValues(reqData)
 	}
 
-	if reqJson, ok := options.RawGetString("json").(lua.LString); ok {
+	switch reqJson := options.RawGetString("json").(type) {
+	case lua.LString:
 		ro.JSON = reqJson.String()
+	case *lua.LTable:
+		data, err := encodeJSON(reqJson)
+		if err != nil {
+			return nil, err
+		}
+		ro.JSON = string(data)
 	}
 
 	if reqXml, ok := options.RawGetString("xml").(lua.LString); ok {
@@ -253,6 +447,26 @@ func parseOptions(options *lua.LTable) (*requestOptions, error) {
 		ro.RawQuery = reqQuery.String()
 	}
 
+	// Files are opened last so that no other option can fail and leak them
+	if reqFiles, ok := options.RawGetString("files").(*lua.LTable); ok {
+		var err error
+		reqFiles.ForEach(func(fieldName, filePath lua.LValue) {
+			if err != nil {
+				return
+			}
+			fu, ferr := fileUploadFromDisk(fieldName.String(), filePath.String())
+			if ferr != nil {
+				err = ferr
+				return
+			}
+			ro.Files = append(ro.Files, fu)
+		})
+		if err != nil {
+			ro.CloseFiles()
+			return nil, err
+		}
+	}
+
 	return ro, nil
 }
 
@@ -263,56 +477,131 @@ func (self *httpModule) createTransport(ro requestOptions) *http.Transport {
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 		Proxy:              ro.proxySettings,
-		TLSClientConfig:    &tls.Config{InsecureSkipVerify: ro.InsecureSkipVerify},
+		TLSClientConfig:    ro.tlsConfig(),
 		DisableCompression: ro.DisableCompression,
 		DisableKeepAlives:  true,
 	}
 
+	dial := self.dialer(ro)
+
+	// TLS is set up here rather than by the transport so that the wireConn sees the
+	// plain requests, the tunnels of https requests sent through an http proxy too
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return newWireConn(conn), nil
+	}
+	transport.DialTLSContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if proxyURL, ok := ctx.Value(tunnelProxyKey{}).(*url.URL); ok {
+			conn, err = dialTunnel(ctx, dial, proxyURL, address, &ro)
+		} else {
+			conn, err = dial(ctx, network, address)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		config := transport.TLSClientConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		return newTLSWireConn(conn, config, transport.TLSHandshakeTimeout), nil
+	}
+
+	return transport
+}
+
+// dialer returns the dial function of the transports, it goes through the dns
+// cache and the socks proxy of the context when there are and sets the read and
+// write timeouts of the connection
+func (self *httpModule) dialer(ro requestOptions) dialFunc {
+	dialer := &net.Dialer{Timeout: ro.Timeout}
+	if self.policy != nil {
+		dialer.Control = self.policy.control
+	}
+	direct := dialFunc(dialer.DialContext)
 	if self.resolver != nil {
-		transport.Dial = func(network, address string) (net.Conn, error) {
+		direct = func(ctx context.Context, network, address string) (net.Conn, error) {
 			host, port, _ := net.SplitHostPort(address)
-			ip, err := self.resolver.FetchOneString(host)
+			ip, err := self.fetchIP(ctx, host)
 			if err != nil {
 				return nil, err
 			}
-			conn, err := net.DialTimeout(network, net.JoinHostPort(ip, port), ro.Timeout)
-			if err != nil {
-				return nil, err
-			}
-			return newTimeoutConn(conn, ro.Timeout), nil
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
 		}
-	} else {
-		transport.Dial = func(network, address string) (net.Conn, error) {
-			conn, err := net.DialTimeout(network, address, ro.Timeout)
-			if err != nil {
-				return nil, err
-			}
-			return newTimeoutConn(conn, ro.Timeout), nil
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if proxyURL, ok := ctx.Value(socksProxyKey{}).(*url.URL); ok {
+			conn, err = self.dialSocks(ctx, proxyURL, network, address, direct)
+		} else {
+			conn, err = direct(ctx, network, address)
+		}
+		if err != nil {
+			return nil, err
 		}
+		return newTimeoutConn(conn, ro.Timeout), nil
 	}
+}
 
-	return transport
+// fetchIP resolves host through the dns cache, reporting the lookup to the
+// client trace since it bypasses the net package resolver
+func (self *httpModule) fetchIP(ctx context.Context, host string) (string, error) {
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+
+	ip, err := self.resolver.FetchOneString(host)
+
+	if trace != nil && trace.DNSDone != nil {
+		info := httptrace.DNSDoneInfo{Err: err}
+		if err == nil {
+			info.Addrs = []net.IPAddr{{IP: net.ParseIP(ip)}}
+		}
+		trace.DNSDone(info)
+	}
+	return ip, err
 }
 
 func (self *httpModule) buildClient(ro requestOptions) *http.Client {
-	// The function does not return an error ever... so we are just ignoring it
-	cookieJar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	return newClient(ro, newCookieJar(), self.createTransport(ro))
+}
+
+// newClient builds a client around an existing cookie jar and transport so that
+// sessions can share them between requests
+func newClient(ro requestOptions, jar http.CookieJar, transport http.RoundTripper) *http.Client {
+	transport = &proxyTransport{transport: transport, ro: ro}
 
 	client := &http.Client{
-		Jar:       cookieJar,
-		Transport: self.createTransport(ro),
+		Jar:       jar,
+		Transport: transport,
 		Timeout:   ro.Timeout,
 	}
 
-	if ro.DisableRedirect {
-		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		}
+	// The decisions are recorded so that the responses can tell why a redirect
+	// was followed or not
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		decision, err := ro.checkRedirect(req, via)
+		redirectLogFrom(req.Context()).record(req.Response, decision)
+		return err
 	}
 
 	return client
 }
 
+func newCookieJar() http.CookieJar {
+	// The function does not return an error ever... so we are just ignoring it
+	cookieJar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	return cookieJar
+}
+
 func buildRequest(method, urlStr string, ro *requestOptions) (*http.Request, error) {
 	if ro.RawData != "" {
 		return http.NewRequest(method, urlStr, strings.NewReader(ro.RawData))
@@ -423,8 +712,10 @@ func createMultiPartPostRequest(method, urlStr string, ro *requestOptions) (*htt
 	}
 
 	// Populate the other parts of the form (if there are any)
-	for key, value := range ro.Data {
-		multipartWriter.WriteField(key, value)
+	for key, values := range ro.Data {
+		for _, value := range values {
+			multipartWriter.WriteField(key, value)
+		}
 	}
 
 	if err := multipartWriter.Close(); err != nil {
@@ -455,32 +746,150 @@ func createBasicRequest(method, urlStr string, ro *requestOptions) (*http.Reques
 	return req, nil
 }
 
-func (self *httpModule) doRequest(L *lua.LState, method, urlStr string, options *lua.LTable) (lua.LValue, error) {
-	ro, err := parseOptions(options)
+// preparedRequest is a request built from the options of the script, ready to be sent
+type preparedRequest struct {
+	ro     *requestOptions
+	req    *http.Request
+	client *http.Client
+	tracer *tracer
+	quota  *quotaTransport
+
+	// do is client.Do wrapped by the interceptors of the module
+	do RoundTripFunc
+}
+
+// prepareRequest parses the options and builds the request and its client,
+// the caller has to close the files of the options once the request is sent
+func (self *httpModule) prepareRequest(L *lua.LState, sess *session, method, urlStr string, options *lua.LTable) (*preparedRequest, error) {
+	if sess != nil {
+		options = mergeOptions(L, sess.options, options)
+	}
+
+	ro, err := parseOptions(options, self.config)
 	if err != nil {
-		return lua.LNil, err
+		return nil, newRequestError(KindInvalidOptions, urlStr, err)
 	}
-	defer ro.CloseFiles()
 
-	urlStr, err = buildURL(urlStr, ro)
+	fullURL, err := buildURL(urlStr, ro)
 	if err != nil {
-		return lua.LNil, err
+		ro.CloseFiles()
+		return nil, newRequestError(KindInvalidURL, urlStr, err)
 	}
+	urlStr = fullURL
 
 	req, err := buildRequest(method, urlStr, ro)
 	if err != nil {
-		return lua.LNil, err
+		ro.CloseFiles()
+		return nil, newRequestError(KindInvalidRequest, urlStr, err)
+	}
+
+	// Canceling the context of the state aborts dialing, the TLS handshake, the
+	// body reads and the waits between retries
+	if ctx := L.Context(); ctx != nil {
+		req = req.WithContext(ctx)
 	}
+	req = withRedirectLog(req)
 
 	addHeaders(req, ro)
 	addCookies(req, ro)
 
-	client := self.buildClient(*ro)
-	resp, err := client.Do(req)
+	if err := ro.Hooks.beforeRequest(L, req); err != nil {
+		ro.CloseFiles()
+		return nil, err
+	}
+
+	var client *http.Client
+	if sess != nil {
+		client = sess.buildClient(*ro)
+	} else {
+		client = self.buildClient(*ro)
+	}
+
+	if ro.RedirectCallback != nil || (ro.Hooks != nil && ro.Hooks.OnRedirect != nil) {
+		checkRedirect := client.CheckRedirect
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if err := checkRedirect(req, via); err != nil {
+				return err
+			}
+			return ro.luaRedirect(L, req)
+		}
+	}
+
+	// The quota is checked inside the policy, blocked requests aren't counted
+	var quota *quotaTransport
+	if q := self.quotaFor(L); q != nil {
+		quota = &quotaTransport{transport: client.Transport, quota: q}
+		client.Transport = quota
+	}
+
+	if self.policy != nil {
+		client.Transport = &policyTransport{transport: client.Transport, module: self, ro: *ro}
+	}
+
+	tracer := newTracer(client.Transport, ro)
+	client.Transport = tracer
+
+	return &preparedRequest{
+		ro:     ro,
+		req:    req,
+		client: client,
+		tracer: tracer,
+		quota:  quota,
+		do:     chainInterceptors(self.config.Interceptors, client.Do),
+	}, nil
+}
+
+// send sends the request, retrying it as configured by the options
+func (self *preparedRequest) send() (*http.Response, int, error) {
+	resp, attempts, err := doWithRetry(self.do, self.req, self.ro.Retry)
+	if err != nil && self.req.Context().Err() != nil {
+		// The state or the future was canceled, even when its deadline expired
+		canceled := classifyError(err)
+		canceled.Kind = KindCanceled
+		canceled.Timeout = false
+		canceled.Temporary = false
+		if canceled.URL == "" {
+			canceled.URL = self.req.URL.String()
+		}
+		err = canceled
+	}
+	return resp, attempts, err
+}
+
+// response converts the response returned by send to lua and passes it to the
+// after_response hook
+func (self *preparedRequest) response(L *lua.LState, resp *http.Response, attempts int) (*lua.LTable, error) {
+	luaResp := getResp(L, resp, self.tracer, self.ro)
+	luaResp.RawSetString("attempts", lua.LNumber(attempts))
+
+	// Reading the body ignores its errors, a body cut by the quota fails the request
+	if err := self.quota.exceeded(); err != nil {
+		return nil, err
+	}
+
+	if err := self.ro.Hooks.afterResponse(L, resp, luaResp); err != nil {
+		return nil, err
+	}
+	return luaResp, nil
+}
+
+func (self *httpModule) doRequest(L *lua.LState, sess *session, method, urlStr string, options *lua.LTable) (lua.LValue, error) {
+	prepared, err := self.prepareRequest(L, sess, method, urlStr, options)
+	if err != nil {
+		return lua.LNil, err
+	}
+	defer prepared.ro.CloseFiles()
+
+	resp, attempts, err := prepared.send()
 	if err != nil {
 		return lua.LNil, err
 	}
-	return getResp(L, resp), nil
+
+	luaResp, err := prepared.response(L, resp, attempts)
+	if err != nil {
+		return lua.LNil, err
+	}
+	return luaResp, nil
 }
 
 // buildURLParams returns a URL with all of the params
@@ -497,8 +906,8 @@ func buildURL(urlStr string, ro *requestOptions) (string, error) {
 	} else {
 		query := parsedURL.Query()
 		if len(ro.Params) > 0 {
-			for key, value := range ro.Params {
-				query.Set(key, value)
+			for key, values := range ro.Params {
+				query[key] = values
 			}
 		}
 		parsedURL.RawQuery = query.Encode()
@@ -508,15 +917,33 @@ func buildURL(urlStr string, ro *requestOptions) (string, error) {
 }
 
 // addHTTPHeaders adds any additional HTTP headers that need to be added are added here including:
-// 1. Authorization Headers
-// 2. Any other header requested
+// 1. Default headers from the module config
+// 2. Authorization Headers
+// 3. Any other header requested
 func addHeaders(req *http.Request, ro *requestOptions) {
-	req.Header.Set("X-SCANNER", "ZERO")
+	if ro.UserAgent != "" {
+		req.Header.Set("User-Agent", ro.UserAgent)
+	}
 
-	for key, value := range ro.Headers {
+	for key, value := range ro.DefaultHeaders {
 		req.Header.Set(key, value)
 	}
 
+	// An empty array removes the header, default ones included. The transport
+	// only writes the Host of the request
+	for key, values := range ro.Headers {
+		if strings.EqualFold(key, "Host") {
+			if len(values) > 0 {
+				req.Host = values[0]
+			}
+			continue
+		}
+		req.Header.Del(key)
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
 	if ro.Host != "" {
 		req.Host = ro.Host
 	}
@@ -540,12 +967,66 @@ func escapeQuotes(s string) string {
 	return quoteEscaper.Replace(s)
 }
 
-func encodePostValues(postValues map[string]string) string {
-	urlValues := &url.Values{}
+func encodePostValues(postValues url.Values) string {
+	return postValues.Encode() // This will sort all of the keys, values keep their order
+}
+
+// parseHeaders accepts { Name = "value", Name2 = {"value1", "value2"} } or an
+// array of pairs like { {"name", "value"}, {"Name2", "value"} } which keeps the
+// order and the casing of the names on the wire
+func parseHeaders(table *lua.LTable) (map[string][]string, []string, error) {
+	headers := map[string][]string{}
+	var order []string
+	for i := 1; i <= table.Len(); i++ {
+		pair, ok := table.RawGetInt(i).(*lua.LTable)
+		if !ok || pair.Len() != 2 {
+			return nil, nil, fmt.Errorf("header %d must be a {name, value} pair", i)
+		}
 
-	for key, value := range postValues {
-		urlValues.Set(key, value)
+		name := pair.RawGetInt(1).String()
+		key := http.CanonicalHeaderKey(name)
+		headers[key] = append(headers[key], pair.RawGetInt(2).String())
+		order = append(order, name)
 	}
 
-	return urlValues.Encode() // This will sort all of the string values
+	// Named headers can be mixed with the pairs, they are written after them and
+	// replace the pairs of the same name. They're sorted so that names differing
+	// only by their casing are always applied in the same order
+	named := map[string]lua.LValue{}
+	var names []string
+	table.ForEach(func(key, value lua.LValue) {
+		if _, ok := key.(lua.LNumber); !ok {
+			named[key.String()] = value
+			names = append(names, key.String())
+		}
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		headers[http.CanonicalHeaderKey(name)] = luaStrings(named[name])
+	}
+	return headers, order, nil
+}
+
+// luaValues converts { key = "value", key2 = {"value1", "value2"} } into a map
+// of multiple values, array values are kept in order
+func luaValues(table *lua.LTable) map[string][]string {
+	values := map[string][]string{}
+	table.ForEach(func(key, value lua.LValue) {
+		values[key.String()] = luaStrings(value)
+	})
+	return values
+}
+
+// luaStrings returns the items of an array or the value itself
+func luaStrings(value lua.LValue) []string {
+	array, ok := value.(*lua.LTable)
+	if !ok {
+		return []string{value.String()}
+	}
+
+	items := []string{}
+	for i := 1; i <= array.Len(); i++ {
+		items = append(items, array.RawGetInt(i).String())
+	}
+	return items
 }
@@ -1,6 +1,7 @@
 package gluahttp
 
 import (
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -8,31 +9,100 @@ import (
 	"github.com/yuin/gopher-lua"
 )
 
-func getResp(L *lua.LState, resp *http.Response) *lua.LTable {
-	luaResp := makeResp(L, resp)
-	luaResp.RawSetString("history", getHistory(L, resp))
+const responseTypeName = "http.response"
+
+func registerResponseType(L *lua.LState) {
+	mt := L.NewTypeMetatable(responseTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"json": responseJSON,
+		"xml":  responseXML,
+	}))
+}
+
+// responseJSON decodes the body of the response, resp:json({big_int_as_string = true})
+// keeps integers which don't fit into a lua number as strings
+func responseJSON(L *lua.LState) int {
+	resp := L.CheckTable(1)
+	var bigIntAsString bool
+	if options := L.OptTable(2, nil); options != nil {
+		bigIntAsString = lua.LVAsBool(options.RawGetString("big_int_as_string"))
+	}
+
+	value, err := decodeJSON(L, lua.LVAsString(resp.RawGetString("body")), bigIntAsString)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	L.Push(value)
+	return 1
+}
+
+func responseXML(L *lua.LState) int {
+	resp := L.CheckTable(1)
+
+	value, err := decodeXML(L, lua.LVAsString(resp.RawGetString("body")))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	L.Push(value)
+	return 1
+}
+
+// getResp converts the final response, with stream its body is returned as a
+// reader instead of being read into memory
+func getResp(L *lua.LState, resp *http.Response, tracer *tracer, ro *requestOptions) *lua.LTable {
+	luaResp := makeResp(L, resp, tracer, ro, ro.Stream)
+	luaResp.RawSetString("history", getHistory(L, resp, tracer, ro))
 	return luaResp
 }
 
-func makeResp(L *lua.LState, resp *http.Response) *lua.LTable {
+func makeResp(L *lua.LState, resp *http.Response, tracer *tracer, ro *requestOptions, stream bool) *lua.LTable {
 	luaResp := L.NewTable()
+	L.SetMetatable(luaResp, L.GetTypeMetatable(responseTypeName))
 	if resp != nil {
 		luaResp.RawSetString("status_code", lua.LNumber(resp.StatusCode))
-		body := getRespBody(resp)
-		luaResp.RawSetString("body", lua.LString(body))
-		luaResp.RawSetString("body_size", lua.LNumber(len(body)))
+		if stream {
+			luaResp.RawSetString("body", newBodyReader(resp.Body).userData(L))
+		} else {
+			body, truncated := getRespBody(resp, ro.MaxBodySize)
+			luaResp.RawSetString("body", lua.LString(body))
+			luaResp.RawSetString("body_size", lua.LNumber(len(body)))
+			luaResp.RawSetString("body_truncated", lua.LBool(truncated))
+		}
 		luaResp.RawSetString("headers", getHeaders(L, resp.Header))
 		luaResp.RawSetString("raw_headers", rawHeaders(resp.Header))
 		luaResp.RawSetString("cookies", getCookies(L, resp.Cookies()))
 		luaResp.RawSetString("raw_cookies", rawCookies(resp.Cookies()))
 		luaResp.RawSetString("proto", lua.LString(resp.Proto))
 		luaResp.RawSetString("url", lua.LString(resp.Request.URL.String()))
-		luaResp.RawSetString("request", makeReq(L, resp.Request))
+		trip := tracer.trip(resp)
+		luaResp.RawSetString("request", makeReq(L, resp.Request, trip))
+		if resp.TLS != nil {
+			luaResp.RawSetString("tls", getTLS(L, resp.TLS))
+		}
+		if trip != nil {
+			luaResp.RawSetString("timings", trip.timings(L))
+		}
+		if received, truncated := trip.receivedRaw(); received != nil {
+			luaResp.RawSetString("raw", lua.LString(received))
+			luaResp.RawSetString("raw_truncated", lua.LBool(truncated))
+		}
+		if decision := redirectLogFrom(resp.Request.Context()).decision(resp); decision != nil {
+			luaResp.RawSetString("redirect", decision.table(L))
+		}
 	}
 	return luaResp
 }
 
-func makeReq(L *lua.LState, req *http.Request) *lua.LTable {
+// makeReq describes the request of a hop, raw and raw_headers are the bytes
+// written on the connection when trip recorded them. raw is cut at max_raw_size
+// and raw_truncated tells when it was
+func makeReq(L *lua.LState, req *http.Request, trip *roundTrip) *lua.LTable {
 	luaReq := L.NewTable()
 	if req != nil {
 		luaReq.RawSetString("method", lua.LString(req.Method))
@@ -42,20 +112,26 @@ func makeReq(L *lua.LState, req *http.Request) *lua.LTable {
 		luaReq.RawSetString("host", getHost(req))
 		luaReq.RawSetString("body", lua.LString(getReqBody(req)))
 		luaReq.RawSetString("headers", getHeaders(L, req.Header))
-		luaReq.RawSetString("raw_headers", rawHeaders(req.Header))
 		luaReq.RawSetString("cookies", getCookies(L, req.Cookies()))
 		luaReq.RawSetString("raw_cookies", rawCookies(req.Cookies()))
-		luaReq.RawSetString("raw", rawRequest(req))
+		if sent, truncated := trip.sentRaw(); sent != nil {
+			luaReq.RawSetString("raw_headers", sentHeaders(trip.sentHead()))
+			luaReq.RawSetString("raw", lua.LString(sent))
+			luaReq.RawSetString("raw_truncated", lua.LBool(truncated))
+		} else {
+			luaReq.RawSetString("raw_headers", rawHeaders(req.Header))
+			luaReq.RawSetString("raw", rawRequest(req))
+		}
 	}
 	return luaReq
 }
 
-func getHistory(L *lua.LState, resp *http.Response) *lua.LTable {
+func getHistory(L *lua.LState, resp *http.Response, tracer *tracer, ro *requestOptions) *lua.LTable {
 	history := L.NewTable()
 	subResp := resp.Request.Response
 	for {
 		if subResp != nil {
-			history.Insert(1, makeResp(L, subResp))
+			history.Insert(1, makeResp(L, subResp, tracer, ro, false))
 			subResp = subResp.Request.Response
 		} else {
 			break
@@ -81,14 +157,24 @@ func rawHeaders(headers http.Header) lua.LString {
 	return lua.LString(strings.TrimSuffix(rawHeader, "\r\n"))
 }
 
+// sentHeaders returns the header lines of a head written on the wire
+func sentHeaders(head []byte) lua.LString {
+	headers := strings.TrimSuffix(string(head), string(headerEnd))
+	if i := strings.Index(headers, "\r\n"); i >= 0 {
+		return lua.LString(headers[i+2:])
+	}
+	return ""
+}
+
+// getHeaders returns every header as an array of its values
 func getHeaders(L *lua.LState, headers http.Header) *lua.LTable {
 	table := L.NewTable()
 	for k, v := range headers {
-		var each string
+		values := L.CreateTable(len(v), 0)
 		for _, header := range v {
-			each += header + ","
+			values.Append(lua.LString(header))
 		}
-		table.RawSetString(k, lua.LString(strings.TrimSuffix(each, ",")))
+		table.RawSetString(k, values)
 	}
 	return table
 }
@@ -109,10 +195,21 @@ func getCookies(L *lua.LState, cookies []*http.Cookie) *lua.LTable {
 	return table
 }
 
-func getRespBody(resp *http.Response) string {
-	body, _ := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	return string(body)
+// getRespBody reads the whole body, when limit is positive at most limit bytes
+// are kept and truncated reports whether the body was longer
+func getRespBody(resp *http.Response, limit int64) (body string, truncated bool) {
+	defer resp.Body.Close()
+
+	if limit <= 0 {
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return string(buf), false
+	}
+
+	buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if int64(len(buf)) > limit {
+		return string(buf[:limit]), true
+	}
+	return string(buf), false
 }
 
 func getReqBody(req *http.Request) string {
@@ -138,7 +235,9 @@ func rawRequest(req *http.Request) lua.LString {
 	}
 	rawRequest += "Host: " + host + "\r\n"
 	for key, val := range req.Header {
-		rawRequest += key + ": " + val[0] + "\r\n"
+		for _, v := range val {
+			rawRequest += key + ": " + v + "\r\n"
+		}
 	}
 	rawRequest += "\r\n" + getReqBody(req)
 	return lua.LString(rawRequest)
@@ -0,0 +1,266 @@
+package gluahttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// defaultMaxBackoff caps the delay between two attempts, including the one
+// asked by a Retry-After header
+const defaultMaxBackoff = 30 * time.Second
+
+// retryErrorKinds are the short names accepted in on_error besides the error kinds
+var retryErrorKinds = map[string]string{
+	"reset":   KindConnectionReset,
+	"refused": KindConnectionRefused,
+	"closed":  KindConnectionClosed,
+}
+
+// retryPolicy decides whether a failed attempt is sent again and how long to
+// wait before doing it
+type retryPolicy struct {
+	// Max is the number of retries, the request is sent at most Max+1 times
+	Max int
+
+	// Backoff is one of exponential, linear or constant
+	Backoff string
+
+	// Base is the delay before the first retry
+	Base time.Duration
+
+	// MaxBackoff caps the delay between two attempts
+	MaxBackoff time.Duration
+
+	// Jitter randomizes the delays so that clients don't retry in lockstep
+	Jitter bool
+
+	// OnStatus are the status codes of the responses which are retried
+	OnStatus map[int]bool
+
+	// OnError are the kinds of the errors which are retried
+	OnError map[string]bool
+
+	// RespectRetryAfter waits for the delay asked by the server in Retry-After
+	RespectRetryAfter bool
+}
+
+func defaultRetryPolicy() *retryPolicy {
+	return &retryPolicy{
+		Max:        3,
+		Backoff:    "exponential",
+		Base:       200 * time.Millisecond,
+		MaxBackoff: defaultMaxBackoff,
+		OnStatus:   map[int]bool{502: true, 503: true, 504: true},
+		OnError: map[string]bool{
+			KindTimeout:          true,
+			KindConnectionReset:  true,
+			KindConnectionClosed: true,
+		},
+		RespectRetryAfter: true,
+	}
+}
+
+// parseRetry accepts either the number of retries or a table like
+// { max = 3, backoff = "exponential", base = 0.2, jitter = true, on_status = {502, 503, 504},
+// on_error = {"timeout", "reset"}, respect_retry_after = true }
+func parseRetry(value lua.LValue) (*retryPolicy, error) {
+	policy := defaultRetryPolicy()
+
+	switch value := value.(type) {
+	case lua.LNumber:
+		policy.Max = int(value)
+	case *lua.LTable:
+		if max, ok := value.RawGetString("max").(lua.LNumber); ok {
+			policy.Max = int(max)
+		}
+
+		if backoff, ok := value.RawGetString("backoff").(lua.LString); ok {
+			switch backoff {
+			case "exponential", "linear", "constant":
+				policy.Backoff = backoff.String()
+			default:
+				return nil, fmt.Errorf("unsupported retry backoff %s", backoff)
+			}
+		}
+
+		if base, ok := value.RawGetString("base").(lua.LNumber); ok {
+			policy.Base = time.Duration(float64(base) * float64(time.Second))
+		}
+
+		if maxBackoff, ok := value.RawGetString("max_backoff").(lua.LNumber); ok {
+			policy.MaxBackoff = time.Duration(float64(maxBackoff) * float64(time.Second))
+		}
+
+		if jitter, ok := value.RawGetString("jitter").(lua.LBool); ok {
+			policy.Jitter = bool(jitter)
+		}
+
+		if onStatus, ok := value.RawGetString("on_status").(*lua.LTable); ok {
+			policy.OnStatus = map[int]bool{}
+			onStatus.ForEach(func(_, status lua.LValue) {
+				if code, ok := status.(lua.LNumber); ok {
+					policy.OnStatus[int(code)] = true
+				}
+			})
+		}
+
+		if onError, ok := value.RawGetString("on_error").(*lua.LTable); ok {
+			policy.OnError = map[string]bool{}
+			onError.ForEach(func(_, kind lua.LValue) {
+				if alias, ok := retryErrorKinds[kind.String()]; ok {
+					policy.OnError[alias] = true
+				} else {
+					policy.OnError[kind.String()] = true
+				}
+			})
+		}
+
+		if respect, ok := value.RawGetString("respect_retry_after").(lua.LBool); ok {
+			policy.RespectRetryAfter = bool(respect)
+		}
+	default:
+		return nil, fmt.Errorf("retry must be a number or a table, got %s", value.Type())
+	}
+
+	if policy.Max < 0 {
+		return nil, fmt.Errorf("invalid retry max %d", policy.Max)
+	}
+	if policy.Base < 0 || policy.MaxBackoff < 0 {
+		return nil, fmt.Errorf("retry delays can't be negative")
+	}
+	return policy, nil
+}
+
+// delay returns how long to wait before the given retry, starting at 1
+func (p *retryPolicy) delay(retry int) time.Duration {
+	var delay time.Duration
+	switch p.Backoff {
+	case "linear":
+		delay = p.Base * time.Duration(retry)
+	case "constant":
+		delay = p.Base
+	default:
+		delay = time.Duration(float64(p.Base) * math.Pow(2, float64(retry-1)))
+	}
+
+	if delay > p.MaxBackoff || delay < 0 {
+		delay = p.MaxBackoff
+	}
+
+	// Wait between half and the whole delay
+	if p.Jitter && delay > 0 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	return delay
+}
+
+// retryAfter parses the Retry-After header, which is either a number of
+// seconds or an http date
+func (p *retryPolicy) retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = time.Until(date)
+	} else {
+		return 0, false
+	}
+
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay, true
+}
+
+// doWithRetry sends the request until it succeeds or the policy gives up, it
+// returns the last response or error along with the number of attempts
+func doWithRetry(do RoundTripFunc, req *http.Request, policy *retryPolicy) (*http.Response, int, error) {
+	if policy == nil || policy.Max == 0 {
+		resp, err := do(req)
+		return resp, 1, err
+	}
+
+	// Bodies which can't be read again, like files sent with put, are kept in
+	// memory so that every attempt sends the same bytes
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, 0, err
+		}
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.Body, _ = req.GetBody()
+	}
+
+	attempt := req
+	for attempts := 1; ; attempts++ {
+		resp, err := do(attempt)
+		if attempts > policy.Max {
+			return resp, attempts, err
+		}
+
+		var delay time.Duration
+		if err != nil {
+			if !policy.OnError[classifyError(err).Kind] {
+				return resp, attempts, err
+			}
+			delay = policy.delay(attempts)
+		} else {
+			if !policy.OnStatus[resp.StatusCode] {
+				return resp, attempts, err
+			}
+			delay = policy.delay(attempts)
+			if policy.RespectRetryAfter {
+				if retryAfter, ok := policy.retryAfter(resp); ok {
+					delay = retryAfter
+				}
+			}
+			// Drain the body so that the connection can be reused by the next attempt
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+		}
+
+		if err := sleep(req, delay); err != nil {
+			return nil, attempts, err
+		}
+
+		attempt = req.Clone(req.Context())
+		if req.GetBody != nil {
+			if attempt.Body, err = req.GetBody(); err != nil {
+				return nil, attempts, err
+			}
+		}
+	}
+}
+
+// sleep waits for delay unless the request is canceled in the meantime
+func sleep(req *http.Request, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
@@ -0,0 +1,288 @@
+package gluahttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const sessionTypeName = "http.session"
+
+// mergedOptions are table options whose entries are merged key by key
+// instead of being replaced by the per-request value
+var mergedOptions = map[string]bool{
+	"headers": true,
+	"cookies": true,
+	"params":  true,
+	"proxies": true,
+	"hooks":   true,
+}
+
+// session keeps a cookie jar and keep-alive transports alive between requests,
+// so that login flows don't have to carry cookies by hand
+type session struct {
+	module *httpModule
+
+	// options holds the session level defaults, every request made through the
+	// session merges its own options over them
+	options *lua.LTable
+
+	jar http.CookieJar
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func newSession(module *httpModule, options *lua.LTable) (*session, error) {
+	// Parse the defaults once so that broken options are reported on creation
+	// instead of on the first request
+	ro, err := parseOptions(options, module.config)
+	if err != nil {
+		return nil, err
+	}
+	ro.CloseFiles()
+
+	return &session{
+		module:     module,
+		options:    options,
+		jar:        newCookieJar(),
+		transports: map[string]*http.Transport{},
+	}, nil
+}
+
+func registerSessionType(L *lua.LState) {
+	mt := L.NewTypeMetatable(sessionTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get":      sessionGet,
+		"delete":   sessionDelete,
+		"head":     sessionHead,
+		"patch":    sessionPatch,
+		"post":     sessionPost,
+		"put":      sessionPut,
+		"options":  sessionOptions,
+		"download": sessionDownload,
+		"batch":    sessionBatch,
+		"cookies":  sessionCookies,
+		"close":    sessionClose,
+	}))
+}
+
+func (self *session) userData(L *lua.LState) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = self
+	L.SetMetatable(ud, L.GetTypeMetatable(sessionTypeName))
+	return ud
+}
+
+func checkSession(L *lua.LState) *session {
+	ud := L.CheckUserData(1)
+	if sess, ok := ud.Value.(*session); ok {
+		return sess
+	}
+	L.ArgError(1, "session expected")
+	return nil
+}
+
+func sessionGet(L *lua.LState) int {
+	return checkSession(L).doRequestAndPush(L, "GET", L.CheckString(2), L.ToTable(3))
+}
+
+func sessionDelete(L *lua.LState) int {
+	return checkSession(L).doRequestAndPush(L, "DELETE", L.CheckString(2), L.ToTable(3))
+}
+
+func sessionHead(L *lua.LState) int {
+	return checkSession(L).doRequestAndPush(L, "HEAD", L.CheckString(2), L.ToTable(3))
+}
+
+func sessionPatch(L *lua.LState) int {
+	return checkSession(L).doRequestAndPush(L, "PATCH", L.CheckString(2), L.ToTable(3))
+}
+
+func sessionPost(L *lua.LState) int {
+	return checkSession(L).doRequestAndPush(L, "POST", L.CheckString(2), L.ToTable(3))
+}
+
+func sessionPut(L *lua.LState) int {
+	return checkSession(L).doRequestAndPush(L, "PUT", L.CheckString(2), L.ToTable(3))
+}
+
+func sessionOptions(L *lua.LState) int {
+	return checkSession(L).doRequestAndPush(L, "OPTIONS", L.CheckString(2), L.ToTable(3))
+}
+
+// sessionDownload is http.download sharing the cookies and connections of the session
+func sessionDownload(L *lua.LState) int {
+	sess := checkSession(L)
+	result, err := sess.module.doDownload(L, sess, L.CheckString(2), L.CheckString(3), L.ToTable(4))
+	return pushResponse(L, result, err)
+}
+
+// sessionBatch is http.batch sharing the cookies and connections of the session
+func sessionBatch(L *lua.LState) int {
+	sess := checkSession(L)
+	return sess.module.doBatchAndPush(L, sess, L.CheckTable(2), L.OptTable(3, nil))
+}
+
+// sessionCookies returns the cookies the session would send to the given url
+func sessionCookies(L *lua.LState) int {
+	sess := checkSession(L)
+	urlStr := L.CheckString(2)
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(errorValue(L, newRequestError(KindInvalidURL, urlStr, err)))
+		return 2
+	}
+
+	L.Push(getCookies(L, sess.jar.Cookies(u)))
+	return 1
+}
+
+// sessionClose drops the idle keep-alive connections held by the session
+func sessionClose(L *lua.LState) int {
+	sess := checkSession(L)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	for key, transport := range sess.transports {
+		transport.CloseIdleConnections()
+		delete(sess.transports, key)
+	}
+	return 0
+}
+
+func (self *session) doRequestAndPush(L *lua.LState, method string, url string, options *lua.LTable) int {
+	response, err := self.module.doRequest(L, self, method, url, options)
+	return pushResponse(L, response, err)
+}
+
+func (self *session) buildClient(ro requestOptions) *http.Client {
+	return newClient(ro, self.jar, self.transport(ro))
+}
+
+// transport returns a keep-alive transport shared by every request of the session
+// with the same connection level options
+func (self *session) transport(ro requestOptions) *http.Transport {
+	key := transportKey(ro)
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if transport, ok := self.transports[key]; ok {
+		return transport
+	}
+
+	transport := self.module.createTransport(ro)
+	transport.DisableKeepAlives = false
+	self.transports[key] = transport
+	return transport
+}
+
+// transportKey identifies the options which are baked into an http.Transport
+func transportKey(ro requestOptions) string {
+	schemes := make([]string, 0, len(ro.Proxies))
+	for scheme := range ro.Proxies {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	key := fmt.Sprintf("%t|%t|%s|%s", ro.InsecureSkipVerify, ro.DisableCompression, ro.Timeout, ro.tlsKey())
+	for _, scheme := range schemes {
+		key += "|" + scheme + "=" + ro.Proxies[scheme].String()
+	}
+	return key + "|" + strings.Join(ro.NoProxy, ",")
+}
+
+// mergeOptions returns the session defaults overridden by the request options
+func mergeOptions(L *lua.LState, defaults, options *lua.LTable) *lua.LTable {
+	if defaults == nil {
+		return options
+	}
+
+	merged := L.NewTable()
+	defaults.ForEach(func(key, value lua.LValue) {
+		merged.RawSet(key, value)
+	})
+
+	if options == nil {
+		return merged
+	}
+
+	options.ForEach(func(key, value lua.LValue) {
+		if table, ok := value.(*lua.LTable); ok && mergedOptions[key.String()] {
+			if base, ok := merged.RawGet(key).(*lua.LTable); ok {
+				if key.String() == "headers" {
+					merged.RawSet(key, mergeHeaders(L, base, table))
+				} else {
+					merged.RawSet(key, mergeTables(L, base, table))
+				}
+				return
+			}
+		}
+		merged.RawSet(key, value)
+	})
+
+	return merged
+}
+
+func mergeTables(L *lua.LState, base, override *lua.LTable) *lua.LTable {
+	merged := L.NewTable()
+	base.ForEach(func(key, value lua.LValue) {
+		merged.RawSet(key, value)
+	})
+	override.ForEach(func(key, value lua.LValue) {
+		merged.RawSet(key, value)
+	})
+	return merged
+}
+
+// mergeHeaders drops the session headers the request sets, whatever their form
+// and casing, then appends the {name, value} pairs of the request after the
+// remaining ones of the session. The named headers are kept by name
+func mergeHeaders(L *lua.LState, base, override *lua.LTable) *lua.LTable {
+	overridden := map[string]bool{}
+	eachHeaderName(override, func(name string) {
+		overridden[http.CanonicalHeaderKey(name)] = true
+	})
+
+	merged := L.NewTable()
+	for i := 1; i <= base.Len(); i++ {
+		if pair, ok := base.RawGetInt(i).(*lua.LTable); !ok || !overridden[http.CanonicalHeaderKey(pair.RawGetInt(1).String())] {
+			merged.Append(base.RawGetInt(i))
+		}
+	}
+	for i := 1; i <= override.Len(); i++ {
+		merged.Append(override.RawGetInt(i))
+	}
+
+	base.ForEach(func(key, value lua.LValue) {
+		if _, ok := key.(lua.LNumber); !ok && !overridden[http.CanonicalHeaderKey(key.String())] {
+			merged.RawSet(key, value)
+		}
+	})
+	override.ForEach(func(key, value lua.LValue) {
+		if _, ok := key.(lua.LNumber); !ok {
+			merged.RawSet(key, value)
+		}
+	})
+	return merged
+}
+
+// eachHeaderName calls fn with the name of every pair and named header of headers
+func eachHeaderName(headers *lua.LTable, fn func(name string)) {
+	headers.ForEach(func(key, value lua.LValue) {
+		if _, ok := key.(lua.LNumber); !ok {
+			fn(key.String())
+			return
+		}
+		if pair, ok := value.(*lua.LTable); ok {
+			fn(pair.RawGetInt(1).String())
+		}
+	})
+}
@@ -0,0 +1,208 @@
+package gluahttp
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// roundTrip holds the timestamps of a single hop of a request, redirects
+// produce one roundTrip per response in the history
+type roundTrip struct {
+	mu sync.Mutex
+
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	firstByte    time.Time
+	bodyDone     time.Time
+	reused       bool
+
+	// wire records the request as written on the connection
+	wire *wireHop
+}
+
+func (rt *roundTrip) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			rt.set(&rt.dnsStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			rt.set(&rt.dnsDone)
+		},
+		ConnectStart: func(network, addr string) {
+			rt.mu.Lock()
+			// Dual stack dialing may start several connections, keep the first one
+			if rt.connectStart.IsZero() {
+				rt.connectStart = time.Now()
+			}
+			rt.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				rt.set(&rt.connectDone)
+			}
+		},
+		TLSHandshakeStart: func() {
+			rt.set(&rt.tlsStart)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			rt.set(&rt.tlsDone)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			rt.mu.Lock()
+			rt.reused = info.Reused
+			rt.mu.Unlock()
+
+			if conn, ok := info.Conn.(*wireConn); ok {
+				conn.attach(rt.wire)
+			}
+		},
+		GotFirstResponseByte: func() {
+			rt.set(&rt.firstByte)
+		},
+	}
+}
+
+func (rt *roundTrip) set(t *time.Time) {
+	rt.mu.Lock()
+	*t = time.Now()
+	rt.mu.Unlock()
+}
+
+func (rt *roundTrip) sentHead() []byte {
+	if rt == nil {
+		return nil
+	}
+	return rt.wire.sentHead()
+}
+
+func (rt *roundTrip) sentRaw() ([]byte, bool) {
+	if rt == nil {
+		return nil, false
+	}
+	return rt.wire.sentRaw()
+}
+
+func (rt *roundTrip) receivedRaw() ([]byte, bool) {
+	if rt == nil {
+		return nil, false
+	}
+	return rt.wire.receivedRaw()
+}
+
+// timings returns the duration of each phase in seconds, phases which didn't
+// happen (e.g. dialing on a reused connection) are 0. first_byte is measured from
+// the start of the hop and total ends when the body was read or closed
+func (rt *roundTrip) timings(L *lua.LState) *lua.LTable {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	end := rt.bodyDone
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	table := L.NewTable()
+	table.RawSetString("dns_lookup", elapsed(rt.dnsStart, rt.dnsDone))
+	table.RawSetString("tcp_connect", elapsed(rt.connectStart, rt.connectDone))
+	table.RawSetString("tls_handshake", elapsed(rt.tlsStart, rt.tlsDone))
+	table.RawSetString("first_byte", elapsed(rt.start, rt.firstByte))
+	table.RawSetString("body_transfer", elapsed(rt.firstByte, end))
+	table.RawSetString("total", elapsed(rt.start, end))
+	table.RawSetString("reused", lua.LBool(rt.reused))
+	return table
+}
+
+func elapsed(from, to time.Time) lua.LNumber {
+	if from.IsZero() || to.IsZero() {
+		return 0
+	}
+	return lua.LNumber(to.Sub(from).Seconds())
+}
+
+// tracer wraps the transport of a client and records a roundTrip for every
+// response it returns. headerOrder is applied to every hop written to a wireConn,
+// maxRawSize caps the bytes each of them records and captureRaw records the
+// bytes read too
+type tracer struct {
+	transport   http.RoundTripper
+	headerOrder []string
+	maxRawSize  int64
+	captureRaw  bool
+
+	mu    sync.Mutex
+	trips map[*http.Response]*roundTrip
+}
+
+func newTracer(transport http.RoundTripper, ro *requestOptions) *tracer {
+	return &tracer{
+		transport:   transport,
+		headerOrder: ro.HeaderOrder,
+		maxRawSize:  ro.MaxRawSize,
+		captureRaw:  ro.CaptureRaw,
+		trips:       map[*http.Response]*roundTrip{},
+	}
+}
+
+func (t *tracer) RoundTrip(req *http.Request) (*http.Response, error) {
+	trip := &roundTrip{start: time.Now(), wire: &wireHop{order: t.headerOrder, limit: t.maxRawSize, capture: t.captureRaw}}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trip.clientTrace()))
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &timedBody{ReadCloser: resp.Body, trip: trip}
+
+	t.mu.Lock()
+	t.trips[resp] = trip
+	t.mu.Unlock()
+	return resp, nil
+}
+
+func (t *tracer) trip(resp *http.Response) *roundTrip {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.trips[resp]
+}
+
+// timedBody marks the end of the body transfer when the body hits EOF or is closed
+type timedBody struct {
+	io.ReadCloser
+	trip *roundTrip
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+func (b *timedBody) done() {
+	b.trip.mu.Lock()
+	if b.trip.bodyDone.IsZero() {
+		b.trip.bodyDone = time.Now()
+	}
+	b.trip.mu.Unlock()
+}
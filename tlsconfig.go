@@ -0,0 +1,96 @@
+package gluahttp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var tlsVersionOptions = map[string]uint16{
+	"1":   tls.VersionTLS10,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// readPEM accepts either PEM data or the path of a file containing it
+func readPEM(value string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+// loadClientCertificate loads the certificate used for mutual TLS, when key is
+// empty the private key is expected in the certificate PEM
+func loadClientCertificate(cert, key string) (tls.Certificate, error) {
+	certPEM, err := readPEM(cert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyPEM := certPEM
+	if key != "" {
+		keyPEM, err = readPEM(key)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func loadCABundle(bundle string) ([]byte, error) {
+	data, err := readPEM(bundle)
+	if err != nil {
+		return nil, err
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate found in ca_bundle")
+	}
+	return data, nil
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	if v, ok := tlsVersionOptions[version]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %s", version)
+}
+
+func (ro requestOptions) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		InsecureSkipVerify: ro.InsecureSkipVerify,
+		Certificates:       ro.Certificates,
+		ServerName:         ro.ServerName,
+		MinVersion:         ro.MinTLSVersion,
+		MaxVersion:         ro.MaxTLSVersion,
+	}
+
+	if ro.CABundle != nil {
+		config.RootCAs = x509.NewCertPool()
+		config.RootCAs.AppendCertsFromPEM(ro.CABundle)
+	}
+
+	return config
+}
+
+// tlsKey identifies the TLS settings of the options so that sessions can share
+// a transport between requests using the same certificates
+func (ro requestOptions) tlsKey() string {
+	hash := sha256.New()
+	for _, cert := range ro.Certificates {
+		for _, der := range cert.Certificate {
+			hash.Write(der)
+		}
+	}
+	hash.Write(ro.CABundle)
+
+	return fmt.Sprintf("%s|%s|%d|%d", hex.EncodeToString(hash.Sum(nil)), ro.ServerName, ro.MinTLSVersion, ro.MaxTLSVersion)
+}
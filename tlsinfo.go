@@ -0,0 +1,88 @@
+package gluahttp
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+var tlsVersions = map[uint16]string{
+	tls.VersionSSL30: "SSL 3.0",
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersions[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// getTLS describes the negotiated connection, the peer certificates are the ones
+// sent by the server so they are available even when verify is false
+func getTLS(L *lua.LState, state *tls.ConnectionState) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("version", lua.LString(tlsVersionName(state.Version)))
+	table.RawSetString("cipher_suite", lua.LString(tls.CipherSuiteName(state.CipherSuite)))
+	table.RawSetString("alpn", lua.LString(state.NegotiatedProtocol))
+	table.RawSetString("server_name", lua.LString(state.ServerName))
+	table.RawSetString("resumed", lua.LBool(state.DidResume))
+	table.RawSetString("ocsp_stapled", lua.LBool(len(state.OCSPResponse) > 0))
+	table.RawSetString("ocsp_response", lua.LString(state.OCSPResponse))
+	table.RawSetString("verified", lua.LBool(len(state.VerifiedChains) > 0))
+
+	certs := L.CreateTable(len(state.PeerCertificates), 0)
+	for _, cert := range state.PeerCertificates {
+		certs.Append(getCertificate(L, cert))
+	}
+	table.RawSetString("certificates", certs)
+	return table
+}
+
+func getCertificate(L *lua.LState, cert *x509.Certificate) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("subject", lua.LString(cert.Subject.String()))
+	table.RawSetString("issuer", lua.LString(cert.Issuer.String()))
+	table.RawSetString("serial", lua.LString(cert.SerialNumber.Text(16)))
+	table.RawSetString("not_before", lua.LString(cert.NotBefore.UTC().Format(time.RFC3339)))
+	table.RawSetString("not_after", lua.LString(cert.NotAfter.UTC().Format(time.RFC3339)))
+	table.RawSetString("is_ca", lua.LBool(cert.IsCA))
+
+	sans := L.NewTable()
+	for _, name := range cert.DNSNames {
+		sans.Append(lua.LString(name))
+	}
+	for _, ip := range cert.IPAddresses {
+		sans.Append(lua.LString(ip.String()))
+	}
+	for _, email := range cert.EmailAddresses {
+		sans.Append(lua.LString(email))
+	}
+	for _, uri := range cert.URIs {
+		sans.Append(lua.LString(uri.String()))
+	}
+	table.RawSetString("sans", sans)
+
+	md5Sum := md5.Sum(cert.Raw)
+	sha1Sum := sha1.Sum(cert.Raw)
+	sha256Sum := sha256.Sum256(cert.Raw)
+	fingerprints := L.NewTable()
+	fingerprints.RawSetString("md5", lua.LString(hex.EncodeToString(md5Sum[:])))
+	fingerprints.RawSetString("sha1", lua.LString(hex.EncodeToString(sha1Sum[:])))
+	fingerprints.RawSetString("sha256", lua.LString(hex.EncodeToString(sha256Sum[:])))
+	table.RawSetString("fingerprints", fingerprints)
+
+	table.RawSetString("pem", lua.LString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+	return table
+}
@@ -0,0 +1,276 @@
+package gluahttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headerEnd ends the request line and the headers written by the transport
+var headerEnd = []byte("\r\n\r\n")
+
+// wireConn sits under the HTTP framing and above TLS, so that the requests
+// written to it and the responses read from it are seen as they go on the wire.
+// The hop of the request using the connection is attached by the tracer once
+// the transport got the connection
+type wireConn struct {
+	net.Conn
+
+	// tls is set for https connections, the transport runs the handshake itself
+	// through HandshakeContext so that the client trace sees it
+	tls              *tls.Conn
+	handshakeTimeout time.Duration
+
+	mu  sync.Mutex
+	hop *wireHop
+}
+
+func newWireConn(conn net.Conn) *wireConn {
+	return &wireConn{Conn: conn}
+}
+
+func newTLSWireConn(conn net.Conn, config *tls.Config, handshakeTimeout time.Duration) *wireConn {
+	tlsConn := tls.Client(conn, config)
+	return &wireConn{Conn: tlsConn, tls: tlsConn, handshakeTimeout: handshakeTimeout}
+}
+
+func (c *wireConn) attach(hop *wireHop) {
+	hop.reset()
+
+	c.mu.Lock()
+	c.hop = hop
+	c.mu.Unlock()
+}
+
+func (c *wireConn) current() *wireHop {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hop
+}
+
+func (c *wireConn) Write(b []byte) (int, error) {
+	hop := c.current()
+	if hop == nil {
+		return c.Conn.Write(b)
+	}
+	return hop.write(c.Conn, b)
+}
+
+// Read gives the bytes to the hop attached once they arrived, a read started
+// before a reused connection is attached belongs to the new request
+func (c *wireConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if hop := c.current(); hop != nil {
+			hop.read(b[:n])
+		}
+	}
+	return n, err
+}
+
+// ConnectionState and HandshakeContext let the transport handle the TLS
+// connections returned by DialTLSContext like its own ones
+func (c *wireConn) ConnectionState() tls.ConnectionState {
+	if c.tls == nil {
+		return tls.ConnectionState{}
+	}
+	return c.tls.ConnectionState()
+}
+
+func (c *wireConn) HandshakeContext(ctx context.Context) error {
+	if c.tls == nil {
+		return nil
+	}
+	if c.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.handshakeTimeout)
+		defer cancel()
+	}
+	return c.tls.HandshakeContext(ctx)
+}
+
+// wireHop is a single request written to a wireConn. The request line and the
+// headers are held until they are complete, reordered when the script asked
+// for ordered headers and recorded as sent. Every byte written for the request
+// is kept in sent, up to limit bytes when limit isn't zero. With capture the
+// bytes read for the response are kept in received the same way, under their own
+// lock since the response can be read while the request is still being written
+type wireHop struct {
+	order   []string
+	limit   int64
+	capture bool
+
+	mu            sync.Mutex
+	pending       bytes.Buffer
+	headDone      bool
+	head          []byte
+	sent          bytes.Buffer
+	sentTruncated bool
+
+	receivedMu        sync.Mutex
+	received          bytes.Buffer
+	receivedTruncated bool
+}
+
+// reset starts over when the transport retries the request on another connection
+func (h *wireHop) reset() {
+	h.mu.Lock()
+	h.pending.Reset()
+	h.headDone = false
+	h.head = nil
+	h.sent.Reset()
+	h.sentTruncated = false
+	h.mu.Unlock()
+
+	h.receivedMu.Lock()
+	h.received.Reset()
+	h.receivedTruncated = false
+	h.receivedMu.Unlock()
+}
+
+// record appends b to buf up to the limit of the hop
+func (h *wireHop) record(buf *bytes.Buffer, truncated *bool, b []byte) {
+	if h.limit > 0 {
+		if left := h.limit - int64(buf.Len()); int64(len(b)) > left {
+			b = b[:left]
+			*truncated = true
+		}
+	}
+	buf.Write(b)
+}
+
+func (h *wireHop) read(b []byte) {
+	if !h.capture {
+		return
+	}
+	h.receivedMu.Lock()
+	h.record(&h.received, &h.receivedTruncated, b)
+	h.receivedMu.Unlock()
+}
+
+func (h *wireHop) write(conn net.Conn, b []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.headDone {
+		n, err := conn.Write(b)
+		h.record(&h.sent, &h.sentTruncated, b[:n])
+		return n, err
+	}
+
+	h.pending.Write(b)
+	i := bytes.Index(h.pending.Bytes(), headerEnd)
+	if i < 0 {
+		return len(b), nil
+	}
+
+	buf := h.pending.Bytes()
+	head := reorderHeaders(buf[:i+len(headerEnd)], h.order)
+	rest := buf[i+len(headerEnd):]
+	h.headDone = true
+	h.head = head
+
+	out := make([]byte, 0, len(head)+len(rest))
+	out = append(append(out, head...), rest...)
+	h.pending.Reset()
+	n, err := conn.Write(out)
+	h.record(&h.sent, &h.sentTruncated, out[:n])
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// sentHead returns the request line and the headers as written, nil when the
+// request didn't go through a wireConn
+func (h *wireHop) sentHead() []byte {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.head
+}
+
+// sentRaw returns the bytes written for the request and whether the limit cut
+// them, nil when the request didn't go through a wireConn
+func (h *wireHop) sentRaw() ([]byte, bool) {
+	if h == nil {
+		return nil, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.headDone {
+		return nil, false
+	}
+	return append([]byte(nil), h.sent.Bytes()...), h.sentTruncated
+}
+
+// receivedRaw returns the bytes read for the response and whether the limit cut
+// them, nil when they weren't captured
+func (h *wireHop) receivedRaw() ([]byte, bool) {
+	if h == nil || !h.capture {
+		return nil, false
+	}
+	h.receivedMu.Lock()
+	defer h.receivedMu.Unlock()
+
+	if h.received.Len() == 0 {
+		return nil, false
+	}
+	return append([]byte(nil), h.received.Bytes()...), h.receivedTruncated
+}
+
+// reorderHeaders writes the headers named by order first, in that order and with
+// that casing, the values are the ones the transport wrote. Host stays first
+// unless order places it, the other headers follow in the transport order
+func reorderHeaders(head []byte, order []string) []byte {
+	if len(order) == 0 {
+		return head
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(head), string(headerEnd)), "\r\n")
+	fields := lines[1:]
+	used := make([]bool, len(fields))
+
+	// take returns the first header named name which wasn't written yet
+	take := func(name string) (string, bool) {
+		for i, field := range fields {
+			j := strings.IndexByte(field, ':')
+			if used[i] || j < 0 || !strings.EqualFold(field[:j], name) {
+				continue
+			}
+			used[i] = true
+			return field[j:], true
+		}
+		return "", false
+	}
+
+	out := []string{lines[0]}
+	ordered := map[string]bool{}
+	for _, name := range order {
+		ordered[strings.ToLower(name)] = true
+	}
+	if !ordered["host"] {
+		if value, ok := take("Host"); ok {
+			out = append(out, "Host"+value)
+		}
+	}
+	for _, name := range order {
+		if value, ok := take(name); ok {
+			out = append(out, name+value)
+		}
+	}
+	for i, field := range fields {
+		if !used[i] {
+			out = append(out, field)
+		}
+	}
+
+	return []byte(strings.Join(out, "\r\n") + string(headerEnd))
+}
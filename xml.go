@@ -0,0 +1,101 @@
+package gluahttp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// decodeXML converts an xml document into a tree of element tables:
+// { name = "", ns = "", attrs = { name = value }, children = { element, ... }, text = "" }
+// text holds the character data directly inside the element with surrounding
+// whitespace trimmed
+func decodeXML(L *lua.LState, data string) (lua.LValue, error) {
+	decoder := xml.NewDecoder(strings.NewReader(data))
+	decoder.CharsetReader = charsetReader
+
+	var root *lua.LTable
+	var stack []*lua.LTable
+	var texts []string
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return lua.LNil, fmt.Errorf("invalid xml: %s", err.Error())
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			element := newXMLElement(L, t)
+			if len(stack) > 0 {
+				stack[len(stack)-1].RawGetString("children").(*lua.LTable).Append(element)
+			} else if root == nil {
+				root = element
+			} else {
+				return lua.LNil, fmt.Errorf("invalid xml: multiple root elements at offset %d", decoder.InputOffset())
+			}
+			stack = append(stack, element)
+			texts = append(texts, "")
+		case xml.EndElement:
+			last := len(stack) - 1
+			stack[last].RawSetString("text", lua.LString(strings.TrimSpace(texts[last])))
+			stack, texts = stack[:last], texts[:last]
+		case xml.CharData:
+			if len(texts) > 0 {
+				texts[len(texts)-1] += string(t)
+			}
+		}
+	}
+
+	if root == nil {
+		return lua.LNil, fmt.Errorf("invalid xml: no root element")
+	}
+	return root, nil
+}
+
+func newXMLElement(L *lua.LState, start xml.StartElement) *lua.LTable {
+	attrs := L.NewTable()
+	for _, attr := range start.Attr {
+		name := attr.Name.Local
+		if attr.Name.Space != "" {
+			name = attr.Name.Space + ":" + name
+		}
+		attrs.RawSetString(name, lua.LString(attr.Value))
+	}
+
+	element := L.NewTable()
+	element.RawSetString("name", lua.LString(start.Name.Local))
+	if start.Name.Space != "" {
+		element.RawSetString("ns", lua.LString(start.Name.Space))
+	}
+	element.RawSetString("attrs", attrs)
+	element.RawSetString("children", L.NewTable())
+	return element
+}
+
+// charsetReader supports the single byte latin1 charset besides utf-8, which is
+// what most documents not encoded in utf-8 declare
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	case "iso-8859-1", "latin1", "latin-1":
+		data, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return strings.NewReader(string(runes)), nil
+	}
+	return nil, fmt.Errorf("unsupported charset %s", charset)
+}